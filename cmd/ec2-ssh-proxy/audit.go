@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+ * Audit log
+ */
+
+// AuditLog appends a JSON line when a session starts and another when it
+// ends, which share the session ID, so that the file is never rewritten.
+type AuditLog struct {
+	path string
+}
+
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Profile    string    `json:"profile,omitempty"`
+	Region     string    `json:"region"`
+	InstanceId string    `json:"instance_id"`
+	Name       string    `json:"name,omitempty"`
+	Users      []string  `json:"users,omitempty"`
+	Mode       string    `json:"mode"`
+	Port       int       `json:"port"`
+	SessionId  string    `json:"session_id"`
+	DurationMs *int64    `json:"duration_ms,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func defaultAuditPath() (string, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		h, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(h, ".local", "state")
+	}
+	return filepath.Join(dir, "ec2-ssh-proxy", "audit.log"), nil
+}
+
+// newAuditLog returns nil when the audit log is disabled.
+func newAuditLog(params *Params) *AuditLog {
+	if params.NoAudit {
+		return nil
+	}
+	path := params.AuditFile
+	var err error
+	if path == "" {
+		path, err = defaultAuditPath()
+	} else {
+		path, err = expandPath(path)
+	}
+	if err != nil {
+		logger.Warnf("audit log is disabled: %v", err)
+		return nil
+	}
+	return &AuditLog{path: path}
+}
+
+// write appends the entry. A failure is only warned of, so that the log
+// does not get in the way of connecting.
+func (a *AuditLog) write(e AuditEntry) {
+	e.Time = time.Now()
+	b, err := json.Marshal(e)
+	if err == nil {
+		err = a.append(append(b, '\n'))
+	}
+	if err != nil {
+		logger.Warnf("failed to write the audit log %s: %v", a.path, err)
+	}
+}
+
+func (a *AuditLog) append(b []byte) error {
+	err := os.MkdirAll(filepath.Dir(a.path), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ * Instance cache
+ */
+
+// InstanceCache remembers the instances resolved by selectors, so that
+// reconnecting to the same host does not call DescribeInstances again.
+type InstanceCache struct {
+	path string
+	ttl  time.Duration
+}
+
+type cacheEntry struct {
+	InstanceId       string    `json:"instance_id"`
+	AvailabilityZone string    `json:"availability_zone"`
+	PrivateIp        string    `json:"private_ip"`
+	ImageId          string    `json:"image_id"`
+	Expires          time.Time `json:"expires"`
+	// for --transport eice
+	VpcId    string `json:"vpc_id,omitempty"`
+	SubnetId string `json:"subnet_id,omitempty"`
+	// for the Name tag and --user {tag:KEY}
+	Tags map[string]string `json:"tags,omitempty"`
+	// for --eni-index
+	Interfaces []cacheInterface `json:"interfaces,omitempty"`
+}
+
+type cacheInterface struct {
+	DeviceIndex int64    `json:"device_index"`
+	PrivateIps  []string `json:"private_ips"`
+}
+
+// cacheKey identifies a lookup. Everything that can change its result is
+// included.
+type cacheKey struct {
+	Profile        string   `json:"profile"`
+	Files          []string `json:"shared_files,omitempty"`
+	EnvCredentials string   `json:"env_credentials,omitempty"`
+	AssumeRole     string   `json:"assume_role,omitempty"`
+	Region         string   `json:"region"`
+	Endpoint       string   `json:"endpoint,omitempty"`
+	Id             string   `json:"id,omitempty"`
+	Names          []string `json:"names,omitempty"`
+	NameKey        string   `json:"name_tag_key,omitempty"`
+	PrivateIp      string   `json:"private_ip,omitempty"`
+	PublicIp       string   `json:"public_ip,omitempty"`
+	Allocation     string   `json:"allocation_id,omitempty"`
+	Ipv6           string   `json:"ipv6,omitempty"`
+	PrivateDns     string   `json:"private_dns_name,omitempty"`
+	Tags           []Tag    `json:"tags,omitempty"`
+	Group          string   `json:"placement_group,omitempty"`
+	HostId         string   `json:"host_id,omitempty"`
+	States         []string `json:"states,omitempty"`
+	Index          *int     `json:"index,omitempty"`
+	PickFirst      bool     `json:"pick_first,omitempty"`
+	PickOldest     bool     `json:"pick_oldest,omitempty"`
+}
+
+func defaultCachePath() (string, error) {
+	dir := os.Getenv("XDG_CACHE_HOME")
+	if dir == "" {
+		h, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(h, ".cache")
+	}
+	return filepath.Join(dir, "ec2-ssh-proxy", "instances.json"), nil
+}
+
+// newInstanceCache returns nil when the cache is disabled.
+func newInstanceCache(params *Params) *InstanceCache {
+	if params.NoCache || params.CacheTTL <= 0 {
+		return nil
+	}
+	path, err := defaultCachePath()
+	if err != nil {
+		logger.Infof("instance cache is disabled: %v", err)
+		return nil
+	}
+	return &InstanceCache{path: path, ttl: params.CacheTTL}
+}
+
+func newCacheKey(params *Params, region string) string {
+	// a profile of the same name in other files may be another account
+	var files []string
+	if credentialsFile, configFile, err := sharedFiles(params); err == nil {
+		files = []string{credentialsFile, configFile}
+	}
+	b, _ := json.Marshal(cacheKey{
+		Profile:        params.Profile,
+		Files:          files,
+		EnvCredentials: envCredentialsIdentity(),
+		AssumeRole:     params.AssumeRole,
+		Region:         region,
+		Endpoint:       aws.StringValue(endpointConfig(params.EC2Endpoint, params.EndpointURL).Endpoint),
+		Id:             params.Id,
+		Names:          params.Names,
+		NameKey:        params.NameTagKey,
+		PrivateIp:      params.PrivateIp,
+		PublicIp:       params.PublicIp,
+		Allocation:     params.AllocationId,
+		Ipv6:           params.Ipv6,
+		PrivateDns:     params.PrivateDns,
+		Tags:           params.Tags,
+		Group:          params.PlacementGroup,
+		HostId:         params.HostId,
+		States:         params.States,
+		Index:          params.Index,
+		PickFirst:      params.PickFirst,
+		PickOldest:     params.PickOldest,
+	})
+	return string(b)
+}
+
+// cacheMutex serializes the updates of the cache file, which the lookups of
+// --profiles make in parallel.
+var cacheMutex sync.Mutex
+
+// update modifies the entries of the cache file, read and written back under
+// cacheMutex.
+func (c *InstanceCache) update(f func(m map[string]cacheEntry) bool) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	m := c.load()
+	if f(m) {
+		c.save(m)
+	}
+}
+
+// load reads the cache file. The cache is only an optimization, so a
+// broken file is treated as empty.
+func (c *InstanceCache) load() map[string]cacheEntry {
+	m := map[string]cacheEntry{}
+	b, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return m
+	}
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		logger.Infof("ignoring broken instance cache %s: %v", c.path, err)
+		return map[string]cacheEntry{}
+	}
+	return m
+}
+
+func (c *InstanceCache) save(m map[string]cacheEntry) {
+	now := time.Now()
+	for k, e := range m {
+		if now.After(e.Expires) {
+			delete(m, k)
+		}
+	}
+
+	err := c.write(m)
+	if err != nil {
+		logger.Infof("failed to write the instance cache: %v", err)
+	}
+}
+
+// write replaces the cache file atomically, as other connections may be
+// reading it at the same time.
+func (c *InstanceCache) write(m map[string]cacheEntry) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(c.path)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "instances.*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path)
+}
+
+func (c *InstanceCache) get(key string) *ec2.Instance {
+	e, ok := c.load()[key]
+	if !ok || e.InstanceId == "" || time.Now().After(e.Expires) {
+		return nil
+	}
+	i := &ec2.Instance{
+		InstanceId:       aws.String(e.InstanceId),
+		Placement:        &ec2.Placement{AvailabilityZone: aws.String(e.AvailabilityZone)},
+		PrivateIpAddress: aws.String(e.PrivateIp),
+		ImageId:          aws.String(e.ImageId),
+		VpcId:            aws.String(e.VpcId),
+		SubnetId:         aws.String(e.SubnetId),
+	}
+	keys := make([]string, 0, len(e.Tags))
+	for k := range e.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		i.Tags = append(i.Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(e.Tags[k])})
+	}
+	for _, c := range e.Interfaces {
+		n := &ec2.InstanceNetworkInterface{
+			Attachment: &ec2.InstanceNetworkInterfaceAttachment{DeviceIndex: aws.Int64(c.DeviceIndex)},
+		}
+		for k, ip := range c.PrivateIps {
+			if k == 0 {
+				n.PrivateIpAddress = aws.String(ip)
+			}
+			n.PrivateIpAddresses = append(n.PrivateIpAddresses, &ec2.InstancePrivateIpAddress{
+				PrivateIpAddress: aws.String(ip),
+				Primary:          aws.Bool(k == 0),
+			})
+		}
+		i.NetworkInterfaces = append(i.NetworkInterfaces, n)
+	}
+	return i
+}
+
+func (c *InstanceCache) put(key string, i *ec2.Instance) {
+	e := cacheEntry{
+		InstanceId:       aws.StringValue(i.InstanceId),
+		AvailabilityZone: instanceAZ(i),
+		PrivateIp:        aws.StringValue(i.PrivateIpAddress),
+		ImageId:          aws.StringValue(i.ImageId),
+		VpcId:            aws.StringValue(i.VpcId),
+		SubnetId:         aws.StringValue(i.SubnetId),
+		Expires:          time.Now().Add(c.ttl),
+		Tags:             cacheTags(i),
+		Interfaces:       cacheInterfaces(i),
+	}
+	c.update(func(m map[string]cacheEntry) bool {
+		m[key] = e
+		return true
+	})
+}
+
+func cacheTags(i *ec2.Instance) map[string]string {
+	if len(i.Tags) == 0 {
+		return nil
+	}
+	m := map[string]string{}
+	for _, t := range i.Tags {
+		m[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return m
+}
+
+func cacheInterfaces(i *ec2.Instance) []cacheInterface {
+	var ret []cacheInterface
+	for _, n := range i.NetworkInterfaces {
+		c := cacheInterface{DeviceIndex: deviceIndex(n)}
+		c.PrivateIps = privateIps(&ec2.Instance{NetworkInterfaces: []*ec2.InstanceNetworkInterface{n}})
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+// missing tells whether the lookup is cached as finding no instance.
+func (c *InstanceCache) missing(key string) bool {
+	e, ok := c.load()[key]
+	return ok && e.InstanceId == "" && !time.Now().After(e.Expires)
+}
+
+func (c *InstanceCache) putMissing(key string, ttl time.Duration) {
+	c.update(func(m map[string]cacheEntry) bool {
+		m[key] = cacheEntry{Expires: time.Now().Add(ttl)}
+		return true
+	})
+}
+
+func (c *InstanceCache) delete(key string) {
+	c.update(func(m map[string]cacheEntry) bool {
+		if _, ok := m[key]; !ok {
+			return false
+		}
+		delete(m, key)
+		return true
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+ * Clock skew
+ */
+
+// AWS rejects the signature of a request signed more than 5 minutes apart
+// from its own clock.
+const maxClockSkew = 5 * time.Minute
+
+// isSignatureError tells whether AWS rejected the request signature, which
+// a skewed local clock typically causes.
+func isSignatureError(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	switch aerr.Code() {
+	case "RequestExpired", "SignatureDoesNotMatch", "AuthFailure", "InvalidSignatureException", "RequestTimeTooSkewed":
+		return true
+	}
+	return false
+}
+
+// clockSkew records the difference of the server clock, taken from the
+// Date header of the responses, from the local one, and signs the requests
+// with the server time once adjusted.
+type clockSkew struct {
+	mu       sync.Mutex
+	skew     time.Duration
+	known    bool
+	adjusted bool
+}
+
+// install measures the responses of the service and signs its requests.
+func (s *clockSkew) install(h *request.Handlers) {
+	h.Complete.PushBack(s.measure)
+	h.Sign.Swap(v4.SignRequestHandler.Name, request.NamedHandler{Name: v4.SignRequestHandler.Name, Fn: s.sign})
+}
+
+func (s *clockSkew) measure(r *request.Request) {
+	if r.HTTPResponse == nil {
+		return
+	}
+	t, err := http.ParseTime(r.HTTPResponse.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skew = time.Until(t).Round(time.Second)
+	s.known = true
+}
+
+// offset returns the skew, and whether it is known.
+func (s *clockSkew) offset() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.skew, s.known
+}
+
+// skewed tells whether the local clock is too far off for AWS, with a margin
+// for the latency and the precision of the Date header.
+func (s *clockSkew) skewed() bool {
+	skew, known := s.offset()
+	return known && absDuration(skew) > maxClockSkew-time.Minute
+}
+
+// adjust makes the requests signed with the server time from now on, and
+// tells whether they were not yet.
+func (s *clockSkew) adjust() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.adjusted {
+		return false
+	}
+	s.adjusted = true
+	return true
+}
+
+func (s *clockSkew) sign(r *request.Request) {
+	v4.SignSDKRequestWithCurrentTime(r, s.now)
+}
+
+func (s *clockSkew) now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.adjusted {
+		return time.Now().Add(s.skew)
+	}
+	return time.Now()
+}
+
+// hint explains the signature error.
+func (s *clockSkew) hint(err error) error {
+	if s.skewed() {
+		skew, _ := s.offset()
+		return fmt.Errorf("%v\ncheck your system clock, which is %s off from AWS: AWS rejected the request signature", err, absDuration(skew))
+	}
+	return fmt.Errorf("%v\ncheck your system clock (and the credentials): AWS rejected the request signature", err)
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsSignatureError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{awserr.New("RequestExpired", "expired", nil), true},
+		{awserr.New("SignatureDoesNotMatch", "signature", nil), true},
+		{awserr.New("AuthFailure", "auth", nil), true},
+		{awserr.New("InvalidSignatureException", "signature", nil), true},
+		{awserr.New("RequestTimeTooSkewed", "skewed", nil), true},
+		{fmt.Errorf("sending the key: %w", awserr.New("SignatureDoesNotMatch", "signature", nil)), true},
+		{awserr.New("UnauthorizedOperation", "denied", nil), false},
+		{awserr.New("Throttling", "rate exceeded", nil), false},
+		{errors.New("SignatureDoesNotMatch"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isSignatureError(tt.err); got != tt.want {
+			t.Errorf("isSignatureError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestClockSkewed(t *testing.T) {
+	tests := []struct {
+		skew  time.Duration
+		known bool
+		want  bool
+	}{
+		{0, false, false},
+		{time.Hour, false, false},
+		{0, true, false},
+		{maxClockSkew - time.Minute, true, false},
+		{-(maxClockSkew - time.Minute), true, false},
+		{maxClockSkew - time.Minute + time.Second, true, true},
+		{-(maxClockSkew - time.Minute + time.Second), true, true},
+		{time.Hour, true, true},
+	}
+	for _, tt := range tests {
+		s := clockSkew{skew: tt.skew, known: tt.known}
+		if got := s.skewed(); got != tt.want {
+			t.Errorf("skewed() with %s (known %v) = %v, want %v", tt.skew, tt.known, got, tt.want)
+		}
+	}
+}
+
+func TestCallRetriesSkewed(t *testing.T) {
+	c := &Client{timeout: time.Minute}
+	c.skew.skew = 10 * time.Minute
+	c.skew.known = true
+	calls := 0
+	err := c.call(context.Background(), func(ctx aws.Context) error {
+		calls++
+		if calls == 1 {
+			return awserr.New("SignatureDoesNotMatch", "signature", nil)
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("call() = %v after %d calls, want it retried once", err, calls)
+	}
+	if now := c.skew.now(); now.Sub(time.Now()) < 9*time.Minute {
+		t.Errorf("now() = %s, want the time of AWS", now)
+	}
+
+	// it is not retried again, but explained
+	calls = 0
+	err = c.call(context.Background(), func(ctx aws.Context) error {
+		calls++
+		return awserr.New("SignatureDoesNotMatch", "signature", nil)
+	})
+	if err == nil || calls != 1 || !strings.Contains(err.Error(), "10m0s off from AWS") {
+		t.Errorf("call() = %v after %d calls, want the hint after 1 call", err, calls)
+	}
+
+	// nor when the clock is right
+	c = &Client{timeout: time.Minute}
+	c.skew.known = true
+	calls = 0
+	err = c.call(context.Background(), func(ctx aws.Context) error {
+		calls++
+		return awserr.New("SignatureDoesNotMatch", "signature", nil)
+	})
+	if err == nil || calls != 1 || !strings.Contains(err.Error(), "and the credentials") {
+		t.Errorf("call() = %v after %d calls, want the hint after 1 call", err, calls)
+	}
+}
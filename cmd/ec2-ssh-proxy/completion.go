@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * completion command
+ */
+
+// The scripts call back the command with GO_FLAGS_COMPLETION set, which
+// makes go-flags print the candidates for the last argument.
+var completionScripts = map[string]string{
+	"bash": `_ec2_ssh_proxy() {
+    local IFS=$'\n'
+    COMPREPLY=($(GO_FLAGS_COMPLETION=1 "${COMP_WORDS[0]}" "${COMP_WORDS[@]:1:$COMP_CWORD}" 2>/dev/null))
+    return 0
+}
+complete -o default -F _ec2_ssh_proxy ec2-ssh-proxy
+`,
+	"zsh": `#compdef ec2-ssh-proxy
+_ec2_ssh_proxy() {
+    local -a candidates
+    candidates=("${(@f)$(GO_FLAGS_COMPLETION=1 "${words[1]}" "${(@)words[2,$CURRENT]}" 2>/dev/null)}")
+    compadd -a candidates
+}
+compdef _ec2_ssh_proxy ec2-ssh-proxy
+`,
+	"fish": `function __ec2_ssh_proxy_complete
+    set -l args (commandline -opc) (commandline -ct)
+    set -e args[1]
+    GO_FLAGS_COMPLETION=1 ec2-ssh-proxy $args 2>/dev/null
+end
+complete -c ec2-ssh-proxy -f -a '(__ec2_ssh_proxy_complete)'
+`,
+}
+
+var subcommands = []string{"completion", "doctor", "fan-out", "list", "pattern-test", "ssh-config", "terminate", "version", "whoami"}
+
+func runCompletion(args []string) error {
+	var opts struct {
+		Args struct {
+			SHELL string `description:"bash, zsh or fish"`
+		} `positional-args:"yes" required:"yes"`
+	}
+	_, err := newParser("completion", &opts).ParseArgs(args)
+	if err != nil {
+		return err
+	}
+
+	script, ok := completionScripts[opts.Args.SHELL]
+	if !ok {
+		return fmt.Errorf("unsupported shell: %s (expected bash, zsh or fish)", opts.Args.SHELL)
+	}
+	_, err = fmt.Print(script)
+	return err
+}
+
+// hostArg completes the HOST argument with the Name tags of the running
+// instances.
+type hostArg string
+
+func (hostArg) Complete(match string) []flags.Completion {
+	return completeHosts(os.Args[1:], match)
+}
+
+// portArg completes the PORT argument with commonly used ports. A service
+// name like ssh is taken as well.
+type portArg int
+
+func (p *portArg) UnmarshalFlag(value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		n, err = net.LookupPort("tcp", value)
+		if err != nil {
+			return fmt.Errorf("invalid port: %s", value)
+		}
+	}
+	if n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port number: %d (1-65535)", n)
+	}
+	*p = portArg(n)
+	return nil
+}
+
+func (portArg) Complete(match string) []flags.Completion {
+	var ret []flags.Completion
+	for _, p := range []int{22, 80, 443, 3306, 5432, 6379, 8080} {
+		s := strconv.Itoa(p)
+		if strings.HasPrefix(s, match) {
+			ret = append(ret, flags.Completion{Item: s})
+		}
+	}
+	return ret
+}
+
+const (
+	completionTimeout  = 5 * time.Second
+	completionCacheTTL = time.Minute
+)
+
+// completeHosts looks up the instances with the AWS options in args, which
+// end with the argument being completed. Any error just yields nothing, as
+// there is no way to report it from the shell completion.
+func completeHosts(args []string, match string) []flags.Completion {
+	if len(args) > 0 {
+		args = args[:len(args)-1]
+	}
+	var candidates []string
+	if len(args) == 0 {
+		candidates = append(candidates, subcommands...)
+	}
+	if len(args) > 0 && (args[0] == "list" || args[0] == "fan-out") {
+		args = args[1:]
+	}
+
+	// parse the options given so far without completing them again
+	_ = os.Unsetenv("GO_FLAGS_COMPLETION")
+	var opts struct {
+		configOptions
+		awsOptions
+		selectorOptions
+	}
+	parser := flags.NewParser(&opts, flags.IgnoreUnknown)
+	err := parseArgsWithConfig(parser, args, &opts, &opts.configOptions, &opts.awsOptions, nil)
+	if err == nil {
+		params := Params{}
+		if opts.awsOptions.apply(&params) == nil {
+			params.AWSTimeout = completionTimeout
+			params.SSOLogin = false // never open the browser while completing
+			params.NoMFAPrompt = true
+			params.States = []string{"running"}
+			for _, name := range instanceNames(&params) {
+				candidates = append(candidates, hostForName(opts.Pattern, name))
+			}
+		}
+	}
+
+	var ret []flags.Completion
+	for _, c := range candidates {
+		if strings.HasPrefix(c, match) {
+			ret = append(ret, flags.Completion{Item: c})
+		}
+	}
+	return ret
+}
+
+// hostForName returns the host name matching the first pattern for the
+// instance name, or the name itself when the pattern is not that simple.
+func hostForName(patterns []string, name string) string {
+	if len(patterns) == 0 {
+		return name
+	}
+	p := patterns[0]
+	if strings.ContainsAny(strings.ReplaceAll(p, "{name}", ""), `{}[]()*+?^$|\`) {
+		return name
+	}
+	return strings.ReplaceAll(p, "{name}", name)
+}
+
+// instanceNames returns the names (Name tags) of the running instances, which are
+// cached for a short time as the completion is called for every key stroke.
+func instanceNames(params *Params) []string {
+	path, err := defaultCachePath()
+	if err != nil {
+		return nil
+	}
+	key := params.Profile + "_" + params.Region
+	if params.nameTagKey() != "Name" {
+		key += "_" + params.nameTagKey()
+	}
+	// the profile may be another account in other shared files, and so
+	// may the credentials of the environment
+	if credentialsFile, configFile, err := sharedFiles(params); err == nil {
+		h := sha256.Sum256([]byte(credentialsFile + "\x00" + configFile + "\x00" + envCredentialsIdentity()))
+		key += "_" + hex.EncodeToString(h[:4])
+	}
+	key = strings.NewReplacer("/", "_", `\`, "_").Replace(key)
+	path = filepath.Join(filepath.Dir(path), "names-"+key+".txt")
+
+	fi, err := os.Stat(path)
+	if err == nil && time.Since(fi.ModTime()) < completionCacheTTL {
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			return strings.Fields(string(b))
+		}
+	}
+
+	client, err := newClient(params)
+	if err != nil {
+		return nil
+	}
+	instances, err := client.describeInstances(context.Background(), newDescribeInstancesInput(params, params.States))
+	if err != nil {
+		return nil
+	}
+
+	seen := map[string]bool{}
+	var names []string
+	for _, i := range instances {
+		n := instanceTag(i, params.nameTagKey())
+		if n != "" && !strings.ContainsAny(n, " \t\n") && !seen[n] {
+			seen[n] = true
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	if os.MkdirAll(filepath.Dir(path), 0700) == nil {
+		_ = ioutil.WriteFile(path, []byte(strings.Join(names, "\n")), 0600)
+	}
+	return names
+}
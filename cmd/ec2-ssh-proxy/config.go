@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+/*
+ * Config file
+ */
+
+// Config holds default option values keyed by their long names, such as
+//
+//	user: ec2-user
+//	public-key: ~/.ssh/id_ed25519.pub
+//	profiles:
+//	  prod:
+//	    user: ubuntu
+type Config struct {
+	Options  map[string]interface{}
+	Profiles map[string]map[string]interface{}
+}
+
+type configOptions struct {
+	Config string `long:"config" description:"Config file path (default: ~/.config/ec2-ssh-proxy/config.yaml)"`
+}
+
+func defaultConfigPath() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		h, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(h, ".config")
+	}
+	return filepath.Join(dir, "ec2-ssh-proxy", "config.yaml"), nil
+}
+
+// loadConfig reads the config file. A missing file is only an error when
+// the path was given explicitly.
+func loadConfig(path string) (*Config, error) {
+	explicit := path != ""
+	if explicit {
+		p, err := expandPath(path)
+		if err != nil {
+			return nil, err
+		}
+		path = p
+	} else {
+		p, err := defaultConfigPath()
+		if err != nil {
+			return nil, err
+		}
+		path = p
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]interface{}
+	err = yaml.Unmarshal(b, &m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	c := Config{Options: map[string]interface{}{}, Profiles: map[string]map[string]interface{}{}}
+	for k, v := range m {
+		if k != "profiles" {
+			c.Options[k] = v
+			continue
+		}
+		switch profiles := v.(type) {
+		case map[string]interface{}:
+			for name, p := range profiles {
+				opts, ok := p.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("%s: profiles.%s must be a mapping", path, name)
+				}
+				c.Profiles[name] = opts
+			}
+		case []interface{}, string:
+			// a list of profiles is the --profiles option
+			c.Options[k] = v
+		default:
+			return nil, fmt.Errorf("%s: profiles must be a mapping or a list", path)
+		}
+	}
+	return &c, nil
+}
+
+// parseArgsWithConfig parses args, and then parses them again with the
+// options from the config file prepended to them, so that options given in
+// the command line take precedence over the config file, which takes
+// precedence over the built-in defaults. opts is the options struct of the
+// parser. hostProfile, if not nil, returns the profile the host name chooses
+// with the options parsed so far.
+func parseArgsWithConfig(parser *flags.Parser, args []string, opts interface{}, conf *configOptions, aws *awsOptions, hostProfile func() string) error {
+	_, err := parser.ParseArgs(args)
+	if err != nil {
+		return err
+	}
+	if aws.ProfileFromEnv {
+		if aws.Profile != "" {
+			return fmt.Errorf("--profile-from-env can not be used with --profile")
+		}
+		if v := os.Getenv("AWS_PROFILE"); v != "" {
+			args = append([]string{"--profile", v}, args...)
+			_, err = parser.ParseArgs(args)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	aws.profileFlag = aws.Profile != ""
+
+	c, err := loadConfig(conf.Config)
+	if err != nil {
+		return err
+	}
+
+	// remember the options given in the command line, as parsing again
+	// marks those from the config file as set too
+	given := map[string]bool{}
+	for k := range c.Options {
+		given[k] = isGiven(parser, k)
+	}
+	for _, p := range c.Profiles {
+		for k := range p {
+			given[k] = isGiven(parser, k)
+		}
+	}
+
+	// the top-level options come first, as they may give the patterns and
+	// the mappings the host name chooses the profile with
+	err = parseWithConfigValues(parser, args, c.Options, given)
+	if err != nil {
+		return err
+	}
+
+	// the profile section is chosen by --profile, the host name, the
+	// top-level profile in the config file or AWS_PROFILE, in this order
+	profile := ""
+	if aws.profileFlag {
+		profile = aws.Profile
+	}
+	if profile == "" && hostProfile != nil {
+		profile = hostProfile()
+	}
+	if profile == "" {
+		if p, ok := c.Options["profile"].(string); ok {
+			profile = p
+		}
+	}
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if len(c.Profiles[profile]) == 0 {
+		return nil
+	}
+
+	values := map[string]interface{}{}
+	for k, v := range c.Options {
+		values[k] = v
+	}
+	for k, v := range c.Profiles[profile] {
+		values[k] = v
+	}
+	clearFalseOptions(opts, values, given)
+	return parseWithConfigValues(parser, args, values, given)
+}
+
+// clearFalseOptions sets the boolean fields of opts, a pointer to an options
+// struct, which are false in the values and not given in the command line to
+// false. A field keeps its value of the previous parse, and false has no
+// command line option to override it with.
+func clearFalseOptions(opts interface{}, values map[string]interface{}, given map[string]bool) {
+	clearFalseFields(reflect.ValueOf(opts).Elem(), values, given)
+}
+
+func clearFalseFields(v reflect.Value, values map[string]interface{}, given map[string]bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			clearFalseFields(v.Field(i), values, given)
+			continue
+		}
+		name := f.Tag.Get("long")
+		if name == "" || !f.IsExported() || f.Type.Kind() != reflect.Bool || given[name] {
+			continue
+		}
+		if b, ok := values[name].(bool); ok && !b {
+			v.Field(i).SetBool(false)
+		}
+	}
+}
+
+func isGiven(parser *flags.Parser, name string) bool {
+	opt := parser.FindOptionByLongName(name)
+	return opt != nil && opt.IsSet() && !opt.IsSetDefault()
+}
+
+// parseWithConfigValues parses args with the options of the values
+// prepended, except those given in the command line.
+func parseWithConfigValues(parser *flags.Parser, args []string, values map[string]interface{}, given map[string]bool) error {
+	var extra []string
+	for k, v := range values {
+		// the config file is shared by all the commands, so options
+		// the current one does not support are skipped
+		opt := parser.FindOptionByLongName(k)
+		if opt == nil || k == "config" || given[k] {
+			continue
+		}
+		a, err := configArgs(k, v, opt.Field().Type)
+		if err != nil {
+			return err
+		}
+		extra = append(extra, a...)
+	}
+	if len(extra) == 0 {
+		return nil
+	}
+
+	_, err := parser.ParseArgs(append(extra, args...))
+	return err
+}
+
+func configArgs(name string, v interface{}, t reflect.Type) ([]string, error) {
+	if t.Kind() == reflect.Bool {
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("invalid value in config file: %s must be a boolean", name)
+		}
+		if !b {
+			return nil, nil
+		}
+		return []string{"--" + name}, nil
+	}
+
+	if l, ok := v.([]interface{}); ok {
+		if t.Kind() != reflect.Slice {
+			return nil, fmt.Errorf("invalid value in config file: %s can not be a list", name)
+		}
+		var ret []string
+		for _, e := range l {
+			ret = append(ret, fmt.Sprintf("--%s=%v", name, e))
+		}
+		return ret, nil
+	}
+
+	return []string{fmt.Sprintf("--%s=%v", name, v)}, nil
+}
+
+// optionArgs returns the command line options for the fields of opts, a
+// pointer to an options struct, which differ from their defaults, so that
+// another ec2-ssh-proxy runs with the same options. The embedded option
+// structs are included, and the long names in skip are left out.
+func optionArgs(opts interface{}, skip ...string) []string {
+	v := reflect.ValueOf(opts).Elem()
+	t := v.Type()
+	var ret []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			ret = append(ret, optionArgs(v.Field(i).Addr().Interface(), skip...)...)
+			continue
+		}
+		name := f.Tag.Get("long")
+		if name == "" || !f.IsExported() || containsString(skip, name) {
+			continue
+		}
+		a := fieldArgs(name, v.Field(i), f.Tag.Get("default"))
+		// an optional value is only taken joined to the option
+		if f.Tag.Get("optional") != "" && len(a) == 2 {
+			a = []string{a[0] + "=" + a[1]}
+		}
+		ret = append(ret, a...)
+	}
+	return ret
+}
+
+func fieldArgs(name string, v reflect.Value, def string) []string {
+	switch {
+	case v.Kind() == reflect.Bool:
+		if v.Bool() {
+			return []string{"--" + name}
+		}
+		return nil
+	case v.Kind() == reflect.Slice:
+		var l []string
+		for i := 0; i < v.Len(); i++ {
+			l = append(l, fmt.Sprint(v.Index(i).Interface()))
+		}
+		if def != "" && len(l) == 1 && l[0] == def {
+			return nil
+		}
+		var ret []string
+		for _, e := range l {
+			ret = append(ret, "--"+name, e)
+		}
+		return ret
+	case v.Kind() == reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return []string{"--" + name, fmt.Sprint(v.Elem().Interface())}
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		if d, err := time.ParseDuration(def); err == nil && time.Duration(v.Int()) == d {
+			return nil
+		}
+	}
+	if v.IsZero() && def == "" {
+		return nil
+	}
+	s := fmt.Sprint(v.Interface())
+	if s == def {
+		return nil
+	}
+	return []string{"--" + name, s}
+}
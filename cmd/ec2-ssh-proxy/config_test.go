@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeConfig writes the content to a temporary config file.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testConfig = `user: ec2-user
+pattern:
+  - "{name}.{profile}.aws"
+  - "{name}.{env}.env"
+  - "ec2.{name}"
+env-profile:
+  - stg=staging
+profiles:
+  prod:
+    user: ubuntu
+  staging:
+    user: admin
+  other:
+    user: centos
+`
+
+func TestParseArgsConfigProfileSection(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		profile string
+		env     string
+		want    string
+	}{
+		{"no profile", []string{"ec2.web"}, "", "", "ec2-user"},
+		{"--profile", []string{"--profile", "prod", "ec2.web"}, "", "", "ubuntu"},
+		{"host name", []string{"web.prod.aws"}, "", "", "ubuntu"},
+		{"host name env", []string{"web.stg.env"}, "", "", "admin"},
+		{"--profile over host name", []string{"--profile", "other", "web.prod.aws"}, "", "", "centos"},
+		{"host name over config", []string{"web.prod.aws"}, "other", "", "ubuntu"},
+		{"host name over env", []string{"web.prod.aws"}, "", "other", "ubuntu"},
+		{"config", []string{"ec2.web"}, "other", "", "centos"},
+		{"env", []string{"ec2.web"}, "", "other", "centos"},
+		{"--user over profile", []string{"--user", "root", "web.prod.aws"}, "", "", "root"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setSharedConfig(t, "")
+			content := testConfig
+			if tt.profile != "" {
+				content += "profile: " + tt.profile + "\n"
+			}
+			if tt.env != "" {
+				t.Setenv("AWS_PROFILE", tt.env)
+			}
+			args := append([]string{"--config", writeConfig(t, content), "--no-send-key"}, tt.args...)
+			params, err := parseArgs(append(args, "22"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{tt.want}; !reflect.DeepEqual(params.Users, want) {
+				t.Errorf("Users = %q, want %q", params.Users, want)
+			}
+		})
+	}
+}
+
+func TestParseArgsConfigProfileSectionFalse(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		args   []string
+		want   bool
+	}{
+		{"top-level", "verbose: true\n", nil, true},
+		{"profile false over top-level true", "verbose: true\nprofiles:\n  prod:\n    verbose: false\n", nil, false},
+		{"profile true over top-level false", "verbose: false\nprofiles:\n  prod:\n    verbose: true\n", nil, true},
+		{"other profile", "verbose: true\nprofiles:\n  other:\n    verbose: false\n", nil, true},
+		{"--verbose over profile", "verbose: true\nprofiles:\n  prod:\n    verbose: false\n", []string{"--verbose"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setSharedConfig(t, "")
+			var opts struct {
+				configOptions
+				logOptions
+				awsOptions
+			}
+			args := append([]string{"--config", writeConfig(t, tt.config), "--profile", "prod"}, tt.args...)
+			err := parseArgsWithConfig(newParser("", &opts), args, &opts, &opts.configOptions, &opts.awsOptions, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.Verbose != tt.want {
+				t.Errorf("Verbose = %v, want %v", opts.Verbose, tt.want)
+			}
+		})
+	}
+}
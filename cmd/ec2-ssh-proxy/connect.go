@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+/*
+ * Connect timeout
+ */
+
+// connectWatchdog bounds the time from StartSession until the plugin has
+// established the session, which otherwise hangs silently when the SSM
+// agent is offline. A zero timeout disables it.
+type connectWatchdog struct {
+	timeout  time.Duration
+	start    time.Time
+	deadline time.Time
+
+	mu        sync.Mutex
+	timer     *time.Timer
+	connected bool
+	stopped   bool
+	timedOut  bool
+}
+
+func newConnectWatchdog(timeout time.Duration) *connectWatchdog {
+	now := time.Now()
+	return &connectWatchdog{timeout: timeout, start: now, deadline: now.Add(timeout)}
+}
+
+// context bounds the StartSession call by the deadline.
+func (w *connectWatchdog) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if w.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, w.deadline)
+}
+
+// watch returns the writer for the plugin stdout, which marks the session as
+// established when the marker, or anything if empty, is written. onTimeout
+// is called if that does not happen by the deadline.
+func (w *connectWatchdog) watch(out io.Writer, marker string, onTimeout func()) io.Writer {
+	if w.timeout <= 0 {
+		return out
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.timer = time.AfterFunc(time.Until(w.deadline), func() {
+		w.mu.Lock()
+		fire := !w.connected && !w.stopped
+		w.timedOut = fire
+		w.mu.Unlock()
+		if fire {
+			logger.Infof("the session was not established within %s", w.timeout)
+			onTimeout()
+		}
+	})
+	return &connectWriter{w: out, marker: []byte(marker), watchdog: w}
+}
+
+func (w *connectWatchdog) established() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.connected || w.timedOut {
+		return
+	}
+	w.connected = true
+	w.timer.Stop()
+	logger.Debugf("session established in %s", time.Since(w.start).Round(time.Millisecond))
+}
+
+// stop is called when the plugin has exited.
+func (w *connectWatchdog) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// expired tells whether the session failed to be established in time.
+func (w *connectWatchdog) expired() bool {
+	if w.timeout <= 0 {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.timedOut || (!w.connected && !time.Now().Before(w.deadline))
+}
+
+func (w *connectWatchdog) err() error {
+	return fmt.Errorf("SSM session did not establish within %s, is the SSM agent running and is the instance registered?", w.timeout)
+}
+
+type connectWriter struct {
+	w        io.Writer
+	marker   []byte
+	watchdog *connectWatchdog
+}
+
+func (c *connectWriter) Write(p []byte) (int, error) {
+	if len(c.marker) == 0 || bytes.Contains(p, c.marker) {
+		c.watchdog.established()
+	}
+	return c.w.Write(p)
+}
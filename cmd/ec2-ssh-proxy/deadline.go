@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+ * Deadline
+ */
+
+// deadline bounds the time until the session is started, from looking up
+// the instance to StartSession, and no longer applies once it has started.
+// A nil deadline does nothing.
+type deadline struct {
+	timeout time.Duration
+	timer   *time.Timer
+
+	mu      sync.Mutex
+	phase   string
+	stopped bool
+	expired bool
+}
+
+// withDeadline returns the context canceled at the deadline, unless stopped
+// before. A zero timeout disables it.
+func withDeadline(ctx context.Context, timeout time.Duration) (context.Context, *deadline) {
+	if timeout <= 0 {
+		return ctx, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	d := &deadline{timeout: timeout, phase: "starting"}
+	d.timer = time.AfterFunc(timeout, func() {
+		d.mu.Lock()
+		fire := !d.stopped
+		d.expired = fire
+		d.mu.Unlock()
+		if fire {
+			logger.Infof("the deadline of %s exceeded while %s", timeout, d.current())
+			cancel()
+		}
+	})
+	return ctx, d
+}
+
+// enter records what is being done, to be told on expiry.
+func (d *deadline) enter(phase string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.phase = phase
+}
+
+func (d *deadline) current() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.phase
+}
+
+// stop is called when the session has started.
+func (d *deadline) stop() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stopped = true
+	d.timer.Stop()
+}
+
+// wrap replaces err with the one telling the phase in progress, if the
+// deadline has expired.
+func (d *deadline) wrap(err error) error {
+	if d == nil || err == nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.expired {
+		return err
+	}
+	return fmt.Errorf("the deadline of %s (--deadline) exceeded while %s", d.timeout, d.phase)
+}
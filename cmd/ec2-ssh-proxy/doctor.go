@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"os"
+	"strings"
+)
+
+/*
+ * doctor command
+ */
+
+// errSkipped marks a check which could not be run, as an earlier one failed.
+var errSkipped = errors.New("skipped")
+
+// doctorCheck is one line of the report, with the hint to fix it on failure.
+type doctorCheck struct {
+	name string
+	run  func() (string, error)
+	hint string
+}
+
+func runDoctor(args []string) error {
+	var opts struct {
+		configOptions
+		logOptions
+		awsOptions
+		Plugin string `long:"plugin-path" description:"Path to the session-manager-plugin binary" env:"EC2_SSH_PROXY_PLUGIN_PATH"`
+		MinPV  string `long:"min-plugin-version" description:"Minimum required session-manager-plugin version" default:"1.1.23.0"`
+	}
+	err := parseArgsWithConfig(newParser("doctor", &opts), args, &opts, &opts.configOptions, &opts.awsOptions, nil)
+	if err != nil {
+		return err
+	}
+	err = opts.logOptions.apply()
+	if err != nil {
+		return err
+	}
+	if !versionPattern.MatchString(opts.MinPV) {
+		return fmt.Errorf("invalid session-manager-plugin version: %s", opts.MinPV)
+	}
+
+	params := Params{PluginPath: opts.Plugin, MinPluginVersion: opts.MinPV, NoCache: true, NoAudit: true}
+	err = opts.awsOptions.apply(&params)
+	if err != nil {
+		return err
+	}
+	params.resolveProfile()
+
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+
+	var client *Client
+	checks := []doctorCheck{
+		{
+			name: "session-manager-plugin",
+			run: func() (string, error) {
+				plugin := &SessionManagerPluginImpl{path: params.PluginPath, minVersion: params.MinPluginVersion}
+				if err := plugin.check(); err != nil {
+					return "", err
+				}
+				v, err := plugin.version()
+				return fmt.Sprintf("%s (%s)", v, plugin.path), err
+			},
+			hint: "install or upgrade it: https://docs.aws.amazon.com/systems-manager/latest/userguide/session-manager-working-with-install-plugin.html",
+		},
+		{
+			name: "credentials",
+			run: func() (string, error) {
+				var err error
+				client, err = newClient(&params)
+				if err != nil {
+					return "", err
+				}
+				v, err := client.credentials.Get()
+				if err != nil {
+					return "", err
+				}
+				// only the end of the key, as aws configure list shows it
+				id := v.AccessKeyID
+				if len(id) > 4 {
+					id = strings.Repeat("*", len(id)-4) + id[len(id)-4:]
+				}
+				return fmt.Sprintf("%s from %s", id, v.ProviderName), nil
+			},
+			hint: "run aws configure" + profileOption(params.Profile) + ", or aws sso login for an SSO profile",
+		},
+		{
+			name: "region",
+			run: func() (string, error) {
+				if client == nil {
+					return "", errSkipped
+				}
+				if client.region == "" {
+					return "", fmt.Errorf("no region is configured")
+				}
+				return client.region, nil
+			},
+			hint: "pass --region, or set the region of the profile in ~/.aws/config",
+		},
+		{
+			name: "sts:GetCallerIdentity",
+			run: func() (string, error) {
+				if client == nil || client.region == "" {
+					return "", errSkipped
+				}
+				var out *sts.GetCallerIdentityOutput
+				err := client.call(ctx, func(ctx aws.Context) (err error) {
+					out, err = client.sts.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+					return
+				})
+				if err != nil {
+					return "", err
+				}
+				return aws.StringValue(out.Arn), nil
+			},
+			hint: "check that the credentials are valid and not expired",
+		},
+		{
+			name: "ec2:DescribeInstances",
+			run: func() (string, error) {
+				if client == nil || client.region == "" {
+					return "", errSkipped
+				}
+				err := client.call(ctx, func(ctx aws.Context) error {
+					_, err := client.ec2.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{DryRun: aws.Bool(true)})
+					return err
+				})
+				// a dry run fails with DryRunOperation when it would have succeeded
+				var aerr awserr.Error
+				if errors.As(err, &aerr) && aerr.Code() == "DryRunOperation" {
+					return "allowed", nil
+				}
+				if err == nil {
+					return "allowed", nil
+				}
+				return "", err
+			},
+			hint: "allow ec2:DescribeInstances to the IAM identity (see the README for the whole policy)",
+		},
+		{
+			name: "clock",
+			run: func() (string, error) {
+				if client == nil {
+					return "", errSkipped
+				}
+				skew, known := client.skew.offset()
+				if !known {
+					return "", errSkipped
+				}
+				if client.skew.skewed() {
+					return "", fmt.Errorf("the system clock is %s off from AWS", absDuration(skew))
+				}
+				return fmt.Sprintf("%s off from AWS", absDuration(skew)), nil
+			},
+			hint: "synchronize the system clock, e.g. with NTP, as AWS rejects requests signed 5 minutes apart",
+		},
+	}
+
+	var failed int
+	for _, c := range checks {
+		detail, err := c.run()
+		switch {
+		case errors.Is(err, errSkipped):
+			fmt.Printf("[skip] %s\n", c.name)
+		case err != nil:
+			failed++
+			fmt.Printf("[FAIL] %s: %s\n", c.name, strings.ReplaceAll(err.Error(), "\n", "\n       "))
+			fmt.Printf("       hint: %s\n", c.hint)
+		default:
+			fmt.Printf("[ ok ] %s: %s\n", c.name, detail)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	_, _ = fmt.Fprintln(os.Stderr, "all checks passed")
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+ * SSM document
+ */
+
+type documentParameter struct {
+	AllowedValues  []string `json:"allowedValues"`
+	AllowedPattern string   `json:"allowedPattern"`
+}
+
+type documentContent struct {
+	Parameters map[string]documentParameter `json:"parameters"`
+}
+
+// checkDocument validates the session parameters against the constraints of
+// the document, which would otherwise fail in the middle of the session.
+// The check is skipped when the document can not be read.
+func (c *Client) checkDocument(ctx context.Context, in *ssm.StartSessionInput) error {
+	name := aws.StringValue(in.DocumentName)
+	var out *ssm.GetDocumentOutput
+	err := c.call(ctx, func(ctx aws.Context) (err error) {
+		out, err = c.ssm.GetDocumentWithContext(ctx, &ssm.GetDocumentInput{
+			Name:           aws.String(name),
+			DocumentFormat: aws.String(ssm.DocumentFormatJson),
+		})
+		return
+	})
+	if err != nil {
+		logger.Infof("skipping the check of document %s: %v", name, err)
+		return nil
+	}
+
+	var doc documentContent
+	err = json.Unmarshal([]byte(aws.StringValue(out.Content)), &doc)
+	if err != nil {
+		logger.Infof("skipping the check of document %s: %v", name, err)
+		return nil
+	}
+
+	keys := make([]string, 0, len(in.Parameters))
+	for k := range in.Parameters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p, ok := doc.Parameters[k]
+		if !ok {
+			continue
+		}
+		for _, v := range aws.StringValueSlice(in.Parameters[k]) {
+			err := p.check(v)
+			if err != nil {
+				return fmt.Errorf("%s=%s is not allowed by document %s: %v", k, v, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// readParameterFile reads the document parameters in the same shape as the
+// Parameters of StartSession, a JSON object of string arrays.
+func readParameterFile(path string) (map[string][]string, error) {
+	path, err := expandPath(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]json.RawMessage
+	err = json.Unmarshal(b, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: expected a JSON object of string arrays: %v", path, err)
+	}
+	ret := map[string][]string{}
+	for k, v := range raw {
+		var a []string
+		err = json.Unmarshal(v, &a)
+		if err != nil || a == nil {
+			return nil, fmt.Errorf("%s: parameter %s must be an array of strings, got %s", path, k, v)
+		}
+		ret[k] = a
+	}
+	return ret, nil
+}
+
+func (p *documentParameter) check(v string) error {
+	if len(p.AllowedValues) > 0 && !containsString(p.AllowedValues, v) {
+		return fmt.Errorf("allowed values are %s", strings.Join(p.AllowedValues, ", "))
+	}
+	if p.AllowedPattern != "" {
+		re, err := regexp.Compile(p.AllowedPattern)
+		if err != nil {
+			// SSM patterns are not always valid in Go, leave it to SSM
+			return nil
+		}
+		if !re.MatchString(v) {
+			return fmt.Errorf("it must match %s", p.AllowedPattern)
+		}
+	}
+	return nil
+}
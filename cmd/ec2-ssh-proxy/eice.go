@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/net/websocket"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+/*
+ * EC2 Instance Connect Endpoint
+ */
+
+const (
+	transportSSM  = "ssm"
+	transportEICE = "eice"
+)
+
+const (
+	// the longest tunnel EICE allows, in seconds
+	eiceMaxTunnelDuration = 3600
+	// how long the signed URL is valid to open the tunnel
+	eiceSignatureExpiry = time.Minute
+)
+
+// eiceTunnel connects to a port of the instance through an EC2 Instance
+// Connect Endpoint, in place of the SSM session.
+type eiceTunnel struct {
+	credentials *credentials.Credentials
+	region      string
+	endpointId  string
+	dnsName     string
+	privateIp   string
+	port        int
+	bufferSize  int
+	// the time to sign the URL with, which is that of AWS when the local
+	// clock is skewed
+	now func() time.Time
+}
+
+// newTunnel finds the endpoint to reach the instance in its VPC, unless
+// given by --eice-endpoint-id.
+func (c *Client) newTunnel(ctx context.Context, params *Params, i *ec2.Instance, privateIp string) (*eiceTunnel, error) {
+	in := &ec2.DescribeInstanceConnectEndpointsInput{}
+	if params.EICEEndpointId != "" {
+		in.InstanceConnectEndpointIds = []*string{aws.String(params.EICEEndpointId)}
+	} else {
+		vpc := aws.StringValue(i.VpcId)
+		if vpc == "" {
+			return nil, fmt.Errorf("the VPC of %s is unknown, use --eice-endpoint-id", aws.StringValue(i.InstanceId))
+		}
+		in.Filters = []*ec2.Filter{
+			{Name: aws.String("vpc-id"), Values: []*string{aws.String(vpc)}},
+			{Name: aws.String("state"), Values: []*string{aws.String(ec2.Ec2InstanceConnectEndpointStateCreateComplete)}},
+		}
+	}
+
+	var endpoints []*ec2.Ec2InstanceConnectEndpoint
+	err := c.call(ctx, func(ctx aws.Context) error {
+		return c.ec2.DescribeInstanceConnectEndpointsPagesWithContext(ctx, in, func(out *ec2.DescribeInstanceConnectEndpointsOutput, last bool) bool {
+			endpoints = append(endpoints, out.InstanceConnectEndpoints...)
+			return true
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the EC2 Instance Connect Endpoint: %v", err)
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no EC2 Instance Connect Endpoint is found in %s", aws.StringValue(i.VpcId))
+	}
+
+	// prefer the endpoint in the subnet of the instance
+	e := endpoints[0]
+	for _, x := range endpoints {
+		if aws.StringValue(x.SubnetId) == aws.StringValue(i.SubnetId) {
+			e = x
+			break
+		}
+	}
+	dns := aws.StringValue(e.DnsName)
+	if params.FIPS && aws.StringValue(e.FipsDnsName) != "" {
+		dns = aws.StringValue(e.FipsDnsName)
+	}
+	logger.Infof("using EC2 Instance Connect Endpoint %s (%s)", aws.StringValue(e.InstanceConnectEndpointId), dns)
+
+	return &eiceTunnel{
+		credentials: c.credentials,
+		region:      c.region,
+		endpointId:  aws.StringValue(e.InstanceConnectEndpointId),
+		dnsName:     dns,
+		privateIp:   privateIp,
+		port:        params.Port,
+		bufferSize:  params.IOBufferSize,
+		now:         c.skew.now,
+	}, nil
+}
+
+// url returns the URL to open the tunnel, signed as the AWS CLI does.
+func (t *eiceTunnel) url() (string, error) {
+	q := url.Values{}
+	q.Set("instanceConnectEndpointId", t.endpointId)
+	q.Set("remotePort", strconv.Itoa(t.port))
+	q.Set("privateIpAddress", t.privateIp)
+	q.Set("maxTunnelDuration", strconv.Itoa(eiceMaxTunnelDuration))
+	req, err := http.NewRequest(http.MethodGet, "https://"+t.dnsName+"/openTunnel?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	_, err = v4.NewSigner(t.credentials).Presign(req, nil, "ec2-instance-connect", t.region, eiceSignatureExpiry, t.now())
+	if err != nil {
+		return "", fmt.Errorf("failed to sign the tunnel request: %v", err)
+	}
+	req.URL.Scheme = "wss"
+	return req.URL.String(), nil
+}
+
+// run relays the stdio through a tunnel until either side closes it, or ctx
+// is done.
+func (t *eiceTunnel) run(ctx context.Context, stdio PluginStdio) (err error) {
+	if stdio.Proxy {
+		ignoreUserSignals(func() {
+			err = t.relay(ctx, stdio)
+		})
+		return
+	}
+	return t.relay(ctx, stdio)
+}
+
+func (t *eiceTunnel) relay(ctx context.Context, stdio PluginStdio) error {
+	u, err := t.url()
+	if err != nil {
+		return err
+	}
+	config, err := websocket.NewConfig(u, "http://localhost")
+	if err != nil {
+		return err
+	}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to open the tunnel through %s: %v", t.endpointId, err)
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	defer ws.Close()
+	logger.Infof("opened the tunnel to %s:%d through %s", t.privateIp, t.port, t.endpointId)
+	if stdio.Started != nil {
+		stdio.Started(0)
+	}
+
+	input := make(chan error, 1)
+	output := make(chan error, 1)
+	go func() {
+		_, err := copyBuffer(ws, stdio.In, t.bufferSize)
+		input <- err
+	}()
+	go func() {
+		_, err := copyBuffer(stdio.Out, ws, t.bufferSize)
+		output <- err
+	}()
+
+	// the websocket can not be half-closed, so at the end of the input, the
+	// output is read until the endpoint closes the tunnel, as the remote
+	// side closes the connection
+	select {
+	case err = <-input:
+		if err == nil || err == io.EOF {
+			select {
+			case err = <-output:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	case err = <-output:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// listen forwards the local port through a tunnel for each connection, as
+// the plugin does in port-forward mode.
+func (t *eiceTunnel) listen(ctx context.Context, localPort int) error {
+	l, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(localPort)))
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+	if !logger.quiet() {
+		fmt.Printf("Port %d opened for %s:%d.\nWaiting for connections...\n", localPort, t.privateIp, t.port)
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		logger.Infof("accepted a connection from %s", conn.RemoteAddr())
+		go func() {
+			defer conn.Close()
+			err := t.relay(ctx, PluginStdio{In: conn, Out: conn})
+			if err != nil && ctx.Err() == nil {
+				logger.Warnf("%v", err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+/*
+ * Elastic IP
+ */
+
+// withAllocation returns the params selecting the instance associated with
+// the Elastic IP of --eip-allocation-id by its ID, or params as is.
+func (c *Client) withAllocation(ctx context.Context, params *Params) (*Params, error) {
+	if params.AllocationId == "" {
+		return params, nil
+	}
+	a, err := c.describeAddress(ctx, &ec2.DescribeAddressesInput{
+		AllocationIds: []*string{aws.String(params.AllocationId)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return nil, fmt.Errorf("Elastic IP %s is not found", params.AllocationId)
+	}
+	id := aws.StringValue(a.InstanceId)
+	if id == "" {
+		return nil, fmt.Errorf("Elastic IP %s (%s) is not associated with any instance", params.AllocationId, aws.StringValue(a.PublicIp))
+	}
+	logger.Infof("Elastic IP %s (%s) is associated with %s", params.AllocationId, aws.StringValue(a.PublicIp), id)
+	q := *params
+	q.Id = id
+	return &q, nil
+}
+
+// unassociatedAddress tells why no instance has the public IP, when it is an
+// Elastic IP not associated with any instance.
+func (c *Client) unassociatedAddress(ctx context.Context, publicIp string) error {
+	a, err := c.describeAddress(ctx, &ec2.DescribeAddressesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("public-ip"), Values: []*string{aws.String(publicIp)}},
+		},
+	})
+	if err != nil {
+		// only for the error message
+		logger.Infof("failed to look up the Elastic IP %s: %v", publicIp, err)
+		return nil
+	}
+	if a != nil && aws.StringValue(a.InstanceId) == "" {
+		return fmt.Errorf("Elastic IP %s (%s) is not associated with any instance", publicIp, aws.StringValue(a.AllocationId))
+	}
+	return nil
+}
+
+func (c *Client) describeAddress(ctx context.Context, in *ec2.DescribeAddressesInput) (*ec2.Address, error) {
+	var out *ec2.DescribeAddressesOutput
+	err := c.call(ctx, func(ctx aws.Context) (err error) {
+		out, err = c.ec2.DescribeAddressesWithContext(ctx, in)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Addresses) == 0 {
+		return nil, nil
+	}
+	return out.Addresses[0], nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"os"
+	"strings"
+)
+
+/*
+ * Ephemeral SSH key
+ */
+
+// EC2 Instance Connect keeps a pushed key for 60 seconds, so the private half
+// does not need to live longer than that in the agent either.
+const ephemeralKeyLifetime = 60
+
+type EphemeralKey struct {
+	PublicKey string
+
+	priv  ed25519.PrivateKey
+	agent agent.ExtendedAgent
+	conn  net.Conn
+}
+
+// newEphemeralKey generates an ed25519 key pair in memory and hands the
+// private half to the running ssh-agent, which ssh then uses to log in.
+func newEphemeralKey() (*EphemeralKey, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, fmt.Errorf("--ephemeral requires a running ssh-agent (SSH_AUTH_SOCK is not set)")
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ssh-agent: %v", err)
+	}
+
+	k := EphemeralKey{
+		PublicKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " ec2-ssh-proxy-ephemeral",
+		priv:      priv,
+		agent:     agent.NewClient(conn),
+		conn:      conn,
+	}
+	err = k.agent.Add(agent.AddedKey{
+		PrivateKey:   priv,
+		Comment:      "ec2-ssh-proxy-ephemeral",
+		LifetimeSecs: ephemeralKeyLifetime,
+	})
+	if err != nil {
+		k.Close()
+		return nil, fmt.Errorf("failed to add the ephemeral key to ssh-agent: %v", err)
+	}
+
+	return &k, nil
+}
+
+// Close removes the key from ssh-agent and zeroes the private key.
+func (k *EphemeralKey) Close() {
+	if pub, err := ssh.NewPublicKey(k.priv.Public()); err == nil {
+		_ = k.agent.Remove(pub)
+	}
+	for i := range k.priv {
+		k.priv[i] = 0
+	}
+	_ = k.conn.Close()
+}
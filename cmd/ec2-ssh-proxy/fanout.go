@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * fan-out command
+ */
+
+// fanOutStartTimeout is how long a batch of connections may take to start
+// before the next batch is opened anyway.
+const fanOutStartTimeout = 2 * time.Minute
+
+// runFanOut connects to all the instances matching the selector with ssh,
+// each through a proxy of its own selecting it by ID, in the panes of new
+// tmux windows when run in tmux, or prints the commands otherwise.
+func runFanOut(args []string) error {
+	var opts struct {
+		configOptions
+		logOptions
+		awsOptions
+		selectorOptions
+		keyOptions
+		User   string `long:"user" description:"OS user on the EC2 instances" default:"ec2-user"`
+		SSH    string `long:"ssh" description:"ssh command to connect with" default:"ssh"`
+		MaxPar int    `long:"max-parallel" description:"Maximum number of connections to start at once, and of panes in a tmux window" default:"10"`
+		Print  bool   `long:"print" description:"Print the commands even in tmux"`
+		Args   struct {
+			HOST hostArg
+		} `positional-args:"yes"`
+	}
+	hostProfile := func() string { return opts.selectorOptions.hostProfile(string(opts.Args.HOST)) }
+	err := parseArgsWithConfig(newParser("fan-out", &opts), args, &opts, &opts.configOptions, &opts.awsOptions, hostProfile)
+	if err != nil {
+		return err
+	}
+	err = opts.logOptions.apply()
+	if err != nil {
+		return err
+	}
+	if opts.MaxPar < 1 {
+		return fmt.Errorf("--max-parallel must be positive")
+	}
+	if containsString(opts.KeyFile, "-") {
+		return fmt.Errorf("--public-key - can not be used with fan-out")
+	}
+
+	params := Params{}
+	err = opts.awsOptions.apply(&params)
+	if err != nil {
+		return err
+	}
+	err = opts.selectorOptions.apply(&params)
+	if err != nil {
+		return err
+	}
+	if opts.Args.HOST != "" {
+		err = opts.selectorOptions.parseHost(string(opts.Args.HOST), &params)
+	} else {
+		// not to connect to all the instances by mistake
+		err = params.validateSelector()
+	}
+	if err != nil {
+		return err
+	}
+	params.resolveProfile()
+
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+
+	client, err := newClient(&params)
+	if err != nil {
+		return err
+	}
+	lookup, err := client.withAllocation(ctx, &params)
+	if err != nil {
+		return err
+	}
+	instances, err := client.describeInstances(ctx, newDescribeInstancesInput(lookup, params.States))
+	if err != nil {
+		return err
+	}
+	if len(instances) == 0 {
+		return client.instanceNotFound(ctx, lookup)
+	}
+	sort.SliceStable(instances, func(i, j int) bool {
+		return aws.TimeValue(instances[i].LaunchTime).Before(aws.TimeValue(instances[j].LaunchTime))
+	})
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if os.Getenv("TMUX") == "" || opts.Print {
+		for _, i := range instances {
+			fmt.Println(fanOutCommand(exe, opts.SSH, &opts.configOptions, &opts.awsOptions, &opts.keyOptions, &params, client.region, opts.User, i, ""))
+		}
+		return nil
+	}
+
+	// each proxy creates an empty file once started, which opens the next
+	// batch together with the panes closed
+	dir, err := os.MkdirTemp("", "ec2-ssh-proxy-fan-out-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	for start := 0; start < len(instances); start += opts.MaxPar {
+		end := start + opts.MaxPar
+		if end > len(instances) {
+			end = len(instances)
+		}
+		batch := instances[start:end]
+		commands := make([]string, len(batch))
+		files := make([]string, len(batch))
+		for n, i := range batch {
+			files[n] = filepath.Join(dir, aws.StringValue(i.InstanceId))
+			commands[n] = fanOutCommand(exe, opts.SSH, &opts.configOptions, &opts.awsOptions, &opts.keyOptions, &params, client.region, opts.User, i, files[n])
+		}
+		panes, err := tmuxPanes(batch, commands, params.nameTagKey())
+		if err != nil {
+			return err
+		}
+		err = waitPanesStarted(ctx, panes, files)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fanOutCommand is the ssh command connecting to the instance, with all the
+// AWS and key options passed on to the proxy, which creates startedFile once
+// started when given. The instance ID is the host name, and hence the key in
+// known_hosts.
+func fanOutCommand(exe string, sshCommand string, conf *configOptions, awsOpts *awsOptions, keyOpts *keyOptions, params *Params, region string, user string, i *ec2.Instance, startedFile string) string {
+	proxy := []string{exe}
+	if conf.Config != "" {
+		proxy = append(proxy, "--config", conf.Config)
+	}
+	// the profile and the region resolved from the host name too
+	if params.Profile != "" {
+		proxy = append(proxy, "--profile", params.Profile)
+	}
+	proxy = append(proxy, "--region", region)
+	proxy = append(proxy, optionArgs(awsOpts, "profile", "profile-from-env", "region")...)
+	proxy = append(proxy, optionArgs(keyOpts)...)
+	if startedFile != "" {
+		proxy = append(proxy, "--started-file", startedFile)
+	}
+	proxy = append(proxy, "--instance-id", aws.StringValue(i.InstanceId), "%h", "%p", "%r")
+
+	cmd := strings.Fields(sshCommand)
+	for _, k := range keyOpts.KeyFile {
+		if p := privateKeyPath(k); p != "" {
+			cmd = append(cmd, "-i", p)
+		}
+	}
+	cmd = append(cmd, "-l", user, "-o", "ProxyCommand="+shellJoin(proxy), aws.StringValue(i.InstanceId))
+	return shellJoin(cmd)
+}
+
+// tmuxPanes runs the commands in the tiled panes of a new window, named
+// after the first instance, and returns the IDs of the panes.
+func tmuxPanes(instances []*ec2.Instance, commands []string, nameKey string) ([]string, error) {
+	name := instanceTag(instances[0], nameKey)
+	if name == "" {
+		name = aws.StringValue(instances[0].InstanceId)
+	}
+	out, err := exec.Command("tmux", "new-window", "-P", "-F", "#{window_id} #{pane_id}", "-n", name, commands[0]).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a tmux window: %v", err)
+	}
+	ids := strings.Fields(string(out))
+	if len(ids) != 2 {
+		return nil, fmt.Errorf("unexpected output of tmux new-window: %q", out)
+	}
+	window := ids[0]
+	panes := []string{ids[1]}
+	for _, c := range commands[1:] {
+		out, err = exec.Command("tmux", "split-window", "-P", "-F", "#{pane_id}", "-t", window, c).Output()
+		if err == nil {
+			panes = append(panes, strings.TrimSpace(string(out)))
+			// re-tiled every time, so that there is room for the next
+			err = exec.Command("tmux", "select-layout", "-t", window, "tiled").Run()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open a tmux pane: %v", err)
+		}
+	}
+	logger.Infof("connecting to %d instances in tmux window %s", len(commands), window)
+	return panes, nil
+}
+
+// waitPanesStarted waits until each pane has created its file, or has
+// exited.
+func waitPanesStarted(ctx context.Context, panes []string, files []string) error {
+	ctx, cancel := context.WithTimeout(ctx, fanOutStartTimeout)
+	defer cancel()
+	waiting := len(panes)
+	done := make([]bool, len(panes))
+	for {
+		for n := range panes {
+			if done[n] {
+				continue
+			}
+			if _, err := os.Stat(files[n]); err == nil {
+				done[n] = true
+			} else if !tmuxPaneAlive(panes[n]) {
+				done[n] = true
+			}
+			if done[n] {
+				waiting--
+			}
+		}
+		if waiting == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				logger.Warnf("%d connections have not started in %v, going on", waiting, fanOutStartTimeout)
+				return nil
+			}
+			return ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// tmuxPaneAlive tells if the pane is open and its command is running.
+func tmuxPaneAlive(pane string) bool {
+	out, err := exec.Command("tmux", "display-message", "-p", "-t", pane, "#{pane_dead}").Output()
+	return err == nil && strings.TrimSpace(string(out)) == "0"
+}
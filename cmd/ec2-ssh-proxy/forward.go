@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Local port forwarding
+ */
+
+// ForwardSpec is a local forward in the ssh -L form, [bind:]port:host:hostport.
+type ForwardSpec struct {
+	BindAddress string
+	Port        int
+	Host        string
+	HostPort    int
+}
+
+func parseForwardSpec(s string) (*ForwardSpec, error) {
+	a, err := splitForwardSpec(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local forward: %s (%v)", s, err)
+	}
+	if len(a) == 3 {
+		a = append([]string{"127.0.0.1"}, a...)
+	}
+	if len(a) != 4 || a[2] == "" {
+		return nil, fmt.Errorf("invalid local forward: %s (expected [bind:]port:host:hostport)", s)
+	}
+	port, err := parseForwardPort(a[1])
+	if err != nil {
+		return nil, err
+	}
+	hostPort, err := parseForwardPort(a[3])
+	if err != nil {
+		return nil, err
+	}
+	return &ForwardSpec{BindAddress: a[0], Port: port, Host: a[2], HostPort: hostPort}, nil
+}
+
+// splitForwardSpec splits the spec at the colons, except in the brackets
+// around IPv6 addresses, which are removed as ssh -L does.
+func splitForwardSpec(s string) ([]string, error) {
+	var ret []string
+	for s != "" || len(ret) == 0 {
+		if strings.HasPrefix(s, "[") {
+			end := strings.Index(s, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("missing ]")
+			}
+			ret = append(ret, s[1:end])
+			s = s[end+1:]
+			if s != "" && !strings.HasPrefix(s, ":") {
+				return nil, fmt.Errorf("expected : after ]")
+			}
+		} else {
+			end := strings.Index(s, ":")
+			if end < 0 {
+				end = len(s)
+			}
+			ret = append(ret, s[:end])
+			s = s[end:]
+		}
+		if s == ":" {
+			ret = append(ret, "")
+		}
+		s = strings.TrimPrefix(s, ":")
+	}
+	return ret, nil
+}
+
+func parseForwardPort(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid local forward port: %s", s)
+	}
+	if n < 1 || n > 65535 {
+		return 0, fmt.Errorf("invalid local forward port number: %d (1-65535)", n)
+	}
+	return n, nil
+}
+
+func (f *ForwardSpec) String() string {
+	return fmt.Sprintf("%s -> %s", net.JoinHostPort(f.BindAddress, strconv.Itoa(f.Port)), f.target())
+}
+
+func (f *ForwardSpec) target() string {
+	return net.JoinHostPort(f.Host, strconv.Itoa(f.HostPort))
+}
+
+// pipeConn is a net.Conn over the stdio of session-manager-plugin.
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+	remote net.Addr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr                { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (c *pipeConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *pipeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *pipeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// localForward logs in to the instance over the SSM session by itself, and
+// forwards the local port to the host through the instance until
+// interrupted.
+func (c *Client) localForward(ctx context.Context, params *Params, instance string, privateIp string) error {
+	config, closeAgent, err := sshClientConfig(params, privateIp)
+	if err != nil {
+		return err
+	}
+	defer closeAgent()
+
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	session := make(chan error, 1)
+	go func() {
+		err := c.runSession(ctx, params, instance, PluginStdio{In: stdinR, Out: stdoutW})
+		_ = stdoutW.CloseWithError(io.EOF)
+		session <- err
+	}()
+	// waitSession waits for the plugin to exit after its stdin is closed,
+	// but not forever
+	waitSession := func() error {
+		_ = stdinW.Close()
+		select {
+		case err := <-session:
+			return err
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	}
+
+	conn := &pipeConn{Reader: stdoutR, WriteCloser: stdinW, remote: &net.TCPAddr{IP: net.ParseIP(privateIp), Port: params.Port}}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, net.JoinHostPort(params.Host, strconv.Itoa(params.Port)), config)
+	if err != nil {
+		if serr := waitSession(); serr != nil {
+			return serr
+		}
+		return fmt.Errorf("ssh login failed: %v", err)
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(params.LocalForward.BindAddress, strconv.Itoa(params.LocalForward.Port)))
+	if err != nil {
+		_ = waitSession()
+		return err
+	}
+	if !logger.quiet() {
+		_, _ = fmt.Fprintf(os.Stderr, "Forwarding %s (press Ctrl-C to stop)\n", params.LocalForward)
+	}
+
+	// stop accepting when interrupted or disconnected
+	go func() {
+		disconnected := make(chan struct{})
+		go func() {
+			_ = client.Wait()
+			close(disconnected)
+		}()
+		select {
+		case <-ctx.Done():
+		case <-disconnected:
+		}
+		_ = ln.Close()
+	}()
+	if params.Keepalive > 0 {
+		go keepalive(client, params.Keepalive)
+	}
+
+	var wg sync.WaitGroup
+	for {
+		lc, err := ln.Accept()
+		if err != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			forwardConn(client, lc, params.LocalForward.target(), params.IOBufferSize)
+		}()
+	}
+
+	_ = client.Close()
+	wg.Wait()
+	err = waitSession()
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("the SSH connection is closed")
+}
+
+// keepalive sends keepalive@openssh.com requests, as ServerAliveInterval of
+// ssh does, so that the session is not idle while no connection is
+// forwarded. It returns when the client is closed.
+func keepalive(client *ssh.Client, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		if err != nil {
+			logger.Debugf("failed to send a keep-alive: %v", err)
+			return
+		}
+	}
+}
+
+func forwardConn(client *ssh.Client, lc net.Conn, target string, bufferSize int) {
+	defer lc.Close()
+	rc, err := client.Dial("tcp", target)
+	if err != nil {
+		logger.Warnf("failed to connect to %s: %v", target, err)
+		return
+	}
+	defer rc.Close()
+	logger.Infof("forwarding %s to %s", lc.RemoteAddr(), target)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = copyBuffer(rc, lc, bufferSize)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = copyBuffer(lc, rc, bufferSize)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// sshClientConfig authenticates with the keys in ssh-agent, including the
+// ephemeral one, and the private key next to the public key file.
+func sshClientConfig(params *Params, privateIp string) (*ssh.ClientConfig, func(), error) {
+	var signers []ssh.Signer
+	closeAgent := func() {}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			logger.Warnf("failed to connect to ssh-agent: %v", err)
+		} else {
+			closeAgent = func() { _ = conn.Close() }
+			s, err := agent.NewClient(conn).Signers()
+			if err != nil {
+				logger.Warnf("failed to get the keys from ssh-agent: %v", err)
+			}
+			signers = append(signers, s...)
+		}
+	}
+
+	if params.IdentityFile != "" {
+		s, err := readPrivateKey(params.IdentityFile)
+		if err != nil {
+			logger.Infof("not using %s: %v", params.IdentityFile, err)
+		} else {
+			signers = append(signers, s)
+		}
+	}
+
+	if len(signers) == 0 {
+		closeAgent()
+		return nil, nil, fmt.Errorf("no SSH private key is available for --local-forward (add the key to ssh-agent)")
+	}
+
+	hostKey, err := hostKeyCallback(params.AcceptNewHostKey)
+	if err != nil {
+		closeAgent()
+		return nil, nil, err
+	}
+	return &ssh.ClientConfig{
+		User:            params.Users[0],
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: hostKey,
+		Timeout:         params.AWSTimeout,
+	}, closeAgent, nil
+}
+
+func readPrivateKey(path string) (ssh.Signer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := ssh.ParsePrivateKey(b)
+	var perr *ssh.PassphraseMissingError
+	if errors.As(err, &perr) {
+		return nil, fmt.Errorf("the key is encrypted, add it to ssh-agent instead")
+	}
+	return s, err
+}
+
+// hostKeyCallback verifies the host key with ~/.ssh/known_hosts, where a
+// changed key is an error. The key of an unknown host is added to the file
+// with acceptNew, as StrictHostKeyChecking=accept-new of ssh does, and is an
+// error otherwise.
+func hostKeyCallback(acceptNew bool) (ssh.HostKeyCallback, error) {
+	h, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(h, ".ssh", "known_hosts")
+	known := func(string, net.Addr, ssh.PublicKey) error {
+		return &knownhosts.KeyError{}
+	}
+	if _, err := os.Stat(path); err == nil {
+		known, err = knownhosts.New(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := known(hostname, remote, key)
+		var kerr *knownhosts.KeyError
+		if errors.As(err, &kerr) && len(kerr.Want) == 0 {
+			if !acceptNew {
+				return fmt.Errorf("%s is not a known host, its %s key fingerprint is %s (pass --accept-new-host-key to add it to %s)",
+					hostname, key.Type(), ssh.FingerprintSHA256(key), path)
+			}
+			logger.Warnf("adding the %s key of %s to %s, its fingerprint is %s",
+				key.Type(), hostname, path, ssh.FingerprintSHA256(key))
+			return addKnownHost(path, hostname, key)
+		}
+		if errors.As(err, &kerr) {
+			return fmt.Errorf("host key for %s has changed, possibly a man-in-the-middle attack (see %s)", hostname, path)
+		}
+		return err
+	}, nil
+}
+
+// addKnownHost appends the host key to the known_hosts file, creating it
+// and its directory if missing.
+func addKnownHost(path string, hostname string, key ssh.PublicKey) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitForwardSpec(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []string
+		ok   bool
+	}{
+		{"5432:db:5432", []string{"5432", "db", "5432"}, true},
+		{"0.0.0.0:5432:db:5432", []string{"0.0.0.0", "5432", "db", "5432"}, true},
+		{"[::1]:5432:db:5432", []string{"::1", "5432", "db", "5432"}, true},
+		{"5432:[fd00::1]:5432", []string{"5432", "fd00::1", "5432"}, true},
+		{"5432::5432", []string{"5432", "", "5432"}, true},
+		{"5432:db:", []string{"5432", "db", ""}, true},
+		{"", []string{""}, true},
+		{"[::1:5432:db:5432", nil, false},
+		{"[::1]5432:db:5432", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := splitForwardSpec(tt.spec)
+			if (err == nil) != tt.ok {
+				t.Fatalf("splitForwardSpec(%q) = %v, want ok %v", tt.spec, err, tt.ok)
+			}
+			if tt.ok && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitForwardSpec(%q) = %q, want %q", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseForwardSpec(t *testing.T) {
+	tests := []struct {
+		spec string
+		want *ForwardSpec
+	}{
+		{"5432:db.internal:5432", &ForwardSpec{"127.0.0.1", 5432, "db.internal", 5432}},
+		{"0.0.0.0:8080:web:80", &ForwardSpec{"0.0.0.0", 8080, "web", 80}},
+		{"[::1]:5432:db:5432", &ForwardSpec{"::1", 5432, "db", 5432}},
+		{"5432:[fd00::1]:5432", &ForwardSpec{"127.0.0.1", 5432, "fd00::1", 5432}},
+		{"5432", nil},
+		{"5432:db", nil},
+		{"a:b:5432:db:5432", nil},
+		{"5432::5432", nil},
+		{"port:db:5432", nil},
+		{"5432:db:0", nil},
+		{"65536:db:5432", nil},
+		{"[::1:5432:db:5432", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseForwardSpec(tt.spec)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("parseForwardSpec(%q) = %+v, want an error", tt.spec, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != *tt.want {
+				t.Errorf("parseForwardSpec(%q) = %+v, want %+v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	newKey := func() ssh.PublicKey {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	key := newKey()
+	remote := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}
+
+	strict, err := hostKeyCallback(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = strict("web:22", remote, key)
+	if err == nil || !strings.Contains(err.Error(), "--accept-new-host-key") {
+		t.Errorf("unknown host = %v, want an error", err)
+	}
+
+	acceptNew, err := hostKeyCallback(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = acceptNew("web:22", remote, key)
+	if err != nil {
+		t.Fatalf("unknown host with acceptNew = %v, want it added", err)
+	}
+
+	// the known_hosts file is read again by a new callback
+	strict, err = hostKeyCallback(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = strict("web:22", remote, key)
+	if err != nil {
+		t.Errorf("added host = %v, want it known", err)
+	}
+	err = strict("web:22", remote, newKey())
+	if err == nil || !strings.Contains(err.Error(), "has changed") {
+		t.Errorf("changed key = %v, want an error", err)
+	}
+}
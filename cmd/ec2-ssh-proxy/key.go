@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+/*
+ * SSH public key
+ */
+
+// defaultPublicKeys are tried in order when the public key is not given.
+var defaultPublicKeys = []string{"~/.ssh/id_ed25519.pub", "~/.ssh/id_ecdsa.pub", "~/.ssh/id_rsa.pub"}
+
+// findDefaultPublicKey returns the first of defaultPublicKeys which exists.
+func findDefaultPublicKey() (string, error) {
+	for _, p := range defaultPublicKeys {
+		kf, err := expandPath(p)
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(kf); err == nil {
+			logger.Infof("using the public key %s", kf)
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("no SSH public key is found in ~/.ssh (id_ed25519.pub, id_ecdsa.pub or id_rsa.pub).\n" +
+		"Please create one with ssh-keygen -t ed25519, or use --public-key or --ephemeral")
+}
+
+var supportedKeyTypes = []string{
+	ssh.KeyAlgoRSA,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoED25519,
+}
+
+// expandPath expands environment variables and a leading ~ in path, as a
+// shell does.
+func expandPath(path string) (string, error) {
+	path = os.ExpandEnv(path)
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		h, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(h, path[1:])
+	}
+	return path, nil
+}
+
+// privateKeyPath returns the path of the private key of the public key file,
+// or an empty string if unknown.
+func privateKeyPath(publicKeyPath string) string {
+	p, err := expandPath(publicKeyPath)
+	if err != nil || !strings.HasSuffix(p, ".pub") {
+		return ""
+	}
+	return strings.TrimSuffix(p, ".pub")
+}
+
+func readPublicKey(path string) (string, error) {
+	kf, err := expandPath(path)
+	if err != nil {
+		return "", err
+	}
+	if abs, err := filepath.Abs(kf); err == nil {
+		kf = abs
+	}
+	k, err := ioutil.ReadFile(kf)
+	if os.IsPermission(err) {
+		return "", fmt.Errorf("failed to read the public key %s: permission denied.\n"+
+			"Please check the owner and the mode of the file and its directory (e.g. chmod 644 %s)", kf, kf)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read the public key: %v", err)
+	}
+
+	err = validatePublicKey(k)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", kf, err)
+	}
+	return string(k), nil
+}
+
+// checkPrivateKeyPerms warns when the private key can be read by the group
+// or others, as ssh refuses to use it then, which only turns out after the
+// session has been started. A missing private key is fine, as it may be
+// in ssh-agent.
+func checkPrivateKeyPerms(path string) {
+	if path == "" || runtime.GOOS == "windows" {
+		return
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		logger.Warnf("the private key %s is accessible by others (mode %04o), which ssh refuses to use: chmod 600 %s",
+			path, fi.Mode().Perm(), path)
+	}
+}
+
+// KeyFile is a public key read from the file, and its private key.
+type KeyFile struct {
+	Path         string
+	PublicKey    string
+	IdentityFile string
+}
+
+// readKeyFiles reads all the public keys of --public-key.
+func readKeyFiles(paths []string) ([]KeyFile, error) {
+	var keys []KeyFile
+	for _, path := range paths {
+		k, err := readPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, KeyFile{Path: path, PublicKey: k, IdentityFile: privateKeyPath(path)})
+	}
+	return keys, nil
+}
+
+// useKeyFile makes the key the one to send.
+func (p *Params) useKeyFile(k KeyFile) {
+	p.PublicKey = k.PublicKey
+	p.PublicKeyPath = k.Path
+	p.IdentityFile = k.IdentityFile
+}
+
+// readPublicKeyFrom reads a single line byte by byte, so that nothing after
+// the key is consumed from the stream.
+func readPublicKeyFrom(r io.Reader) (string, error) {
+	var k []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				break
+			}
+			k = append(k, b[0])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err := validatePublicKey(k)
+	if err != nil {
+		return "", fmt.Errorf("stdin: %v", err)
+	}
+	return string(k), nil
+}
+
+// readAgentPublicKey returns the first key in ssh-agent, or the one with the
+// comment if given. ssh then logs in with its private half in the agent.
+func readAgentPublicKey(comment string) (string, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return "", fmt.Errorf("--from-agent requires a running ssh-agent (SSH_AUTH_SOCK is not set)")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to ssh-agent: %v", err)
+	}
+	defer conn.Close()
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return "", fmt.Errorf("failed to get the keys from ssh-agent: %v", err)
+	}
+
+	var comments []string
+	for _, k := range keys {
+		if !containsString(supportedKeyTypes, k.Type()) {
+			continue
+		}
+		if comment == "" || k.Comment == comment {
+			logger.Infof("using the key %s (%s) in ssh-agent", k.Comment, ssh.FingerprintSHA256(k))
+			return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k))) + " " + k.Comment, nil
+		}
+		comments = append(comments, k.Comment)
+	}
+	if comment == "" {
+		return "", fmt.Errorf("no supported SSH key is in ssh-agent (supported: rsa, ecdsa, ed25519)")
+	}
+	return "", fmt.Errorf("no key with comment %s is in ssh-agent (found: %s)", comment, strings.Join(comments, ", "))
+}
+
+// withKeyComment replaces the comment of the key, or appends to it if the
+// comment starts with +. {profile}, {region}, {user} (the local user) and
+// {time} in the comment are expanded.
+func withKeyComment(key string, comment string, profile string, region string) (string, error) {
+	pub, old, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return "", fmt.Errorf("invalid SSH public key: %v", err)
+	}
+
+	local := "unknown"
+	if u, err := user.Current(); err == nil {
+		local = u.Username
+	}
+	comment = strings.NewReplacer(
+		"{profile}", profile,
+		"{region}", region,
+		"{user}", local,
+		"{time}", time.Now().UTC().Format(time.RFC3339),
+		"\n", " ",
+	).Replace(comment)
+	if strings.HasPrefix(comment, "+") {
+		comment = strings.TrimSpace(old + " " + comment[1:])
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))) + " " + comment, nil
+}
+
+func validatePublicKey(k []byte) error {
+	if bytes.Contains(k, []byte("PRIVATE KEY")) {
+		return fmt.Errorf("expected an SSH public key, got what looks like a private key")
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(k)
+	if err != nil {
+		return fmt.Errorf("invalid SSH public key: %v", err)
+	}
+	for _, t := range supportedKeyTypes {
+		if pub.Type() == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported SSH public key type: %s (supported: rsa, ecdsa, ed25519)", pub.Type())
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+ * list command
+ */
+
+type InstanceSummary struct {
+	InstanceId       string    `json:"instance_id"`
+	Name             string    `json:"name"`
+	PrivateIp        string    `json:"private_ip"`
+	PrivateIps       []string  `json:"private_ips"`
+	AvailabilityZone string    `json:"availability_zone"`
+	State            string    `json:"state"`
+	LaunchTime       time.Time `json:"launch_time"`
+	PlacementGroup   string    `json:"placement_group,omitempty"`
+	HostId           string    `json:"host_id,omitempty"`
+}
+
+func newInstanceSummary(i *ec2.Instance, nameKey string) InstanceSummary {
+	s := InstanceSummary{
+		InstanceId:       aws.StringValue(i.InstanceId),
+		Name:             instanceTag(i, nameKey),
+		PrivateIp:        aws.StringValue(i.PrivateIpAddress),
+		PrivateIps:       privateIps(i),
+		AvailabilityZone: instanceAZ(i),
+		State:            instanceState(i),
+		LaunchTime:       aws.TimeValue(i.LaunchTime),
+	}
+	if i.Placement != nil {
+		s.PlacementGroup = aws.StringValue(i.Placement.GroupName)
+		s.HostId = aws.StringValue(i.Placement.HostId)
+	}
+	return s
+}
+
+func runList(args []string) error {
+	var opts struct {
+		configOptions
+		logOptions
+		awsOptions
+		selectorOptions
+		JSON bool `long:"json" description:"Print instances in JSON"`
+		Args struct {
+			HOST hostArg
+		} `positional-args:"yes"`
+	}
+	hostProfile := func() string { return opts.selectorOptions.hostProfile(string(opts.Args.HOST)) }
+	err := parseArgsWithConfig(newParser("list", &opts), args, &opts, &opts.configOptions, &opts.awsOptions, hostProfile)
+	if err != nil {
+		return err
+	}
+	err = opts.logOptions.apply()
+	if err != nil {
+		return err
+	}
+
+	params := Params{}
+	err = opts.awsOptions.apply(&params)
+	if err != nil {
+		return err
+	}
+	err = opts.selectorOptions.apply(&params)
+	if err != nil {
+		return err
+	}
+	if opts.Args.HOST != "" {
+		err = opts.selectorOptions.parseHost(string(opts.Args.HOST), &params)
+		if err != nil {
+			return err
+		}
+	}
+	params.resolveProfile()
+
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+
+	client, err := newClient(&params)
+	if err != nil {
+		return err
+	}
+	lookup, err := client.withAllocation(ctx, &params)
+	if err != nil {
+		return err
+	}
+	instances, err := client.describeInstances(ctx, newDescribeInstancesInput(lookup, params.States))
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(instances, func(i, j int) bool {
+		return aws.TimeValue(instances[i].LaunchTime).Before(aws.TimeValue(instances[j].LaunchTime))
+	})
+
+	summaries := make([]InstanceSummary, len(instances))
+	for n, i := range instances {
+		summaries[n] = newInstanceSummary(i, params.nameTagKey())
+	}
+
+	if opts.JSON {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		return e.Encode(summaries)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "INSTANCE ID\tNAME\tPRIVATE IP\tAZ\tSTATE\tLAUNCH TIME\tPLACEMENT")
+	for n, s := range summaries {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			s.InstanceId, s.Name, s.PrivateIp, s.AvailabilityZone, s.State, s.LaunchTime.Format(time.RFC3339),
+			instancePlacement(instances[n]))
+	}
+	return w.Flush()
+}
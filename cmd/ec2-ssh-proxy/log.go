@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+ * Logging
+ */
+
+type logLevel int
+
+const (
+	levelQuiet logLevel = iota
+	levelError
+	levelInfo
+	levelDebug
+)
+
+// Logger writes leveled diagnostic messages. It goes to stderr, since
+// stdout is the SSH connection.
+type Logger struct {
+	level logLevel
+	out   *log.Logger
+
+	// with --log-format json, messages and events are JSON objects, one
+	// per line, with the fields added to every event
+	json   bool
+	w      io.Writer
+	mu     sync.Mutex
+	fields map[string]interface{}
+}
+
+var logger = newLogger(os.Stderr, levelError)
+
+func newLogger(w io.Writer, level logLevel) *Logger {
+	return &Logger{
+		level:  level,
+		out:    log.New(w, "ec2-ssh-proxy: ", log.Ltime|log.Lmicroseconds),
+		w:      w,
+		fields: map[string]interface{}{},
+	}
+}
+
+func (l *Logger) enabled(level logLevel) bool {
+	return l.level >= level
+}
+
+// quiet tells whether nothing but fatal errors should be printed, and
+// nothing prompted for.
+func (l *Logger) quiet() bool {
+	return l.level == levelQuiet
+}
+
+// Warnf logs unless --quiet.
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	if l.enabled(levelError) {
+		l.printf("warning", "warning: ", format, v...)
+	}
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	if l.enabled(levelInfo) {
+		l.printf("info", "", format, v...)
+	}
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	if l.enabled(levelDebug) {
+		l.printf("debug", "[debug] ", format, v...)
+	}
+}
+
+func (l *Logger) printf(level string, prefix string, format string, v ...interface{}) {
+	if l.json {
+		l.writeJSON(map[string]interface{}{"level": level, "msg": fmt.Sprintf(format, v...)})
+		return
+	}
+	l.out.Printf(prefix+format, v...)
+}
+
+// Event logs what happened with the key and value pairs in kv, such as
+// "instance_id", "i-0123". Events are only logged in JSON, regardless of
+// the level but --quiet, since the messages tell the same in text.
+func (l *Logger) Event(level string, event string, kv ...interface{}) {
+	if !l.json || (l.quiet() && level != "error") {
+		return
+	}
+	m := map[string]interface{}{"level": level, "event": event}
+	l.mu.Lock()
+	for k, v := range l.fields {
+		m[k] = v
+	}
+	l.mu.Unlock()
+	for i := 0; i+1 < len(kv); i += 2 {
+		m[fmt.Sprint(kv[i])] = kv[i+1]
+	}
+	l.writeJSON(m)
+}
+
+// SetField adds the field to the events logged from then on.
+func (l *Logger) SetField(k string, v interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fields[k] = v
+}
+
+func (l *Logger) writeJSON(m map[string]interface{}) {
+	m["time"] = time.Now().Format(time.RFC3339Nano)
+	b, err := json.Marshal(m)
+	if err != nil {
+		b, _ = json.Marshal(map[string]interface{}{"level": "error", "msg": err.Error()})
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(append(b, '\n'))
+}
+
+// logOptions are shared by all the commands.
+type logOptions struct {
+	Verbose bool   `long:"verbose" description:"Log what is being done to stderr"`
+	Debug   bool   `long:"debug" description:"Log AWS requests and responses as well (implies --verbose)"`
+	Format  string `long:"log-format" description:"Log format, json for one object per message or event" choice:"text" choice:"json" default:"text"`
+	Quiet   bool   `long:"quiet" description:"Print nothing but fatal errors, and never prompt"`
+}
+
+func (o *logOptions) apply() error {
+	if o.Quiet && (o.Verbose || o.Debug) {
+		return fmt.Errorf("--quiet can not be used with --verbose or --debug")
+	}
+	switch {
+	case o.Quiet:
+		logger.level = levelQuiet
+	case o.Debug:
+		logger.level = levelDebug
+	case o.Verbose:
+		logger.level = levelInfo
+	}
+	logger.json = o.Format == "json"
+	return nil
+}
+
+// logRequest logs the metadata of a completed AWS API request.
+func logRequest(r *request.Request) {
+	if !logger.enabled(levelDebug) {
+		return
+	}
+	status := 0
+	if r.HTTPResponse != nil {
+		status = r.HTTPResponse.StatusCode
+	}
+	msg := fmt.Sprintf("%s.%s: status=%d request-id=%s retries=%d",
+		r.ClientInfo.ServiceName, r.Operation.Name, status, r.RequestID, r.RetryCount)
+	if r.Error != nil {
+		msg += fmt.Sprintf(" error=%q", r.Error.Error())
+	}
+	logger.Debugf("%s", msg)
+}
+
+// logValue logs an AWS API input or output in JSON.
+func logValue(name string, v interface{}) {
+	if !logger.enabled(levelDebug) {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		logger.Debugf("%s: %v", name, err)
+		return
+	}
+	logger.Debugf("%s: %s", name, b)
+}
@@ -1,264 +1,2174 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/aws/aws-sdk-go/service/ec2instanceconnect"
 	"github.com/aws/aws-sdk-go/service/ec2instanceconnect/ec2instanceconnectiface"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 	"github.com/jessevdk/go-flags"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
-	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 func main() {
 	err := run()
 	if err != nil {
-		_, _ = fmt.Fprintln(os.Stderr, err.Error())
+		if logger.json {
+			logger.Event("error", "error", "error", err.Error())
+		} else {
+			_, _ = fmt.Fprintln(os.Stderr, err.Error())
+		}
+
+		var exitErr *PluginExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
 		os.Exit(1)
 	}
 }
 
-func run() error {
-	params, err := parseArgs(os.Args[1:])
-	if err != nil {
-		return err
+func run() (err error) {
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "list":
+			return runList(args[1:])
+		case "completion":
+			return runCompletion(args[1:])
+		case "ssh-config":
+			return runSSHConfig(args[1:])
+		case "version", "--version":
+			return runVersion(args[1:])
+		case "terminate":
+			return runTerminate(args[1:])
+		case "doctor":
+			return runDoctor(args[1:])
+		case "pattern-test":
+			return runPatternTest(args[1:])
+		case "fan-out":
+			return runFanOut(args[1:])
+		case "whoami", "--whoami":
+			return runWhoami(args[1:])
+		}
+	}
+
+	params, err := parseArgs(args)
+	if err != nil {
+		return err
+	}
+	if params.Mode == modeSSH && params.LocalForward == nil && isFdpass(os.Stdin, os.Stdout) {
+		return fmt.Errorf("ProxyUseFdpass is not supported, as the SSM session can not be passed to ssh as a file descriptor.\n" +
+			"Please set ProxyUseFdpass no for the host")
+	}
+
+	if params.CheckKeyPerms {
+		checkPrivateKeyPerms(params.IdentityFile)
+		for _, k := range params.FallbackKeys {
+			checkPrivateKeyPerms(k.IdentityFile)
+		}
+	}
+
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+	ctx, dl := withDeadline(ctx, params.Deadline)
+	defer func() {
+		err = dl.wrap(err)
+	}()
+
+	dl.enter("looking up the instance")
+	if params.ResolverCommand != "" {
+		params, err = resolveWithCommand(ctx, params)
+		if err != nil {
+			return err
+		}
+	}
+	var client *Client
+	var instance *ec2.Instance
+	if len(params.Profiles) > 0 {
+		client, params, instance, err = findInProfiles(ctx, params)
+	} else {
+		client, err = newClient(params)
+	}
+	if err != nil {
+		return err
+	}
+	client.deadline = dl
+
+	if params.Transport != transportEICE {
+		err = client.checkPlugin()
+		if err != nil {
+			return err
+		}
+	}
+
+	if instance == nil {
+		instance, err = client.findInstance(ctx, params)
+		if err != nil {
+			return err
+		}
+	}
+	instanceId := aws.StringValue(instance.InstanceId)
+	availabilityZone := instanceAZ(instance)
+	privateIp, err := privateIpFor(params, instance)
+	if err != nil {
+		return err
+	}
+	logger.Infof("resolved instance %s (%s) in %s", instanceId, privateIp, availabilityZone)
+	if p := instancePlacement(instance); p != "" {
+		logger.Infof("placement of %s: %s", instanceId, p)
+	}
+	logger.Event("info", "instance_resolved", "host", params.Host, "instance_id", instanceId,
+		"private_ip", privateIp, "availability_zone", availabilityZone)
+	params.ResolvedName = instanceTag(instance, params.nameTagKey())
+	if params.ShowTags {
+		showTags(instance, params.nameTagKey())
+	}
+	err = checkRequiredTags(instance, params.RequiredTags)
+	if err != nil {
+		return err
+	}
+	logger.Debugf("private IPs of %s: %s", instanceId, strings.Join(privateIps(instance), ", "))
+	if params.EniIndex != nil && params.Mode == modePortForward && params.Parameters["host"] == nil {
+		params.Parameters["host"] = []string{privateIp}
+	}
+
+	if params.Mode == modeSSH {
+		params.Users = resolveUsers(params.Users, instance)
+	}
+	if params.DetectUser && params.Mode == modeSSH {
+		params.Users = client.detectUser(ctx, params, instance)
+	}
+
+	if params.Output == "json" {
+		client.report = &Report{
+			InstanceId:       instanceId,
+			Name:             params.ResolvedName,
+			AvailabilityZone: availabilityZone,
+			PrivateIp:        privateIp,
+			Region:           client.region,
+			Profile:          params.Profile,
+			Mode:             params.Mode,
+			Port:             params.Port,
+		}
+		if params.Mode == modeSSH {
+			client.report.Users = params.Users
+		}
+	}
+
+	if params.Transport == transportEICE {
+		dl.enter("looking up the EC2 Instance Connect Endpoint")
+		client.tunnel, err = client.newTunnel(ctx, params, instance, privateIp)
+		if err != nil {
+			return err
+		}
+	}
+
+	if params.DryRun {
+		return client.dryRun(params, instanceId, availabilityZone)
+	}
+
+	if params.WaitForSSM {
+		dl.enter("waiting for the SSM agent")
+		err = client.waitForSSM(ctx, params, instanceId)
+		if err != nil {
+			return err
+		}
+	} else if params.Preflight {
+		dl.enter("checking the instance in SSM")
+		err = client.preflight(ctx, instanceId)
+		if err != nil {
+			return err
+		}
+	}
+
+	// no SSH key is needed to forward a port
+	if params.Mode == modeSSH && !params.NoSendKey {
+		if params.Ephemeral {
+			key, err := newEphemeralKey()
+			if err != nil {
+				return err
+			}
+			defer key.Close()
+			params.PublicKey = key.PublicKey
+		}
+		if params.KeyComment != "" {
+			params.PublicKey, err = withKeyComment(params.PublicKey, params.KeyComment, params.Profile, client.region)
+			if err != nil {
+				return err
+			}
+			for i, k := range params.FallbackKeys {
+				params.FallbackKeys[i].PublicKey, err = withKeyComment(k.PublicKey, params.KeyComment, params.Profile, client.region)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		dl.enter("sending the SSH public key")
+		err = client.sendPublicKey(ctx, params, instanceId, availabilityZone)
+		var derr *SendKeyDeniedError
+		if errors.As(err, &derr) && params.FallbackNoSendKey {
+			logger.Warnf("sending the SSH public key is not allowed, connecting with the key already authorized on the instance: %v", derr.Err)
+			err = nil
+		} else if err == nil && client.report != nil {
+			client.report.PublicKeyFile = params.PublicKeyPath
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if params.Mode == modePortForward && params.LocalPort == 0 {
+		params.LocalPort, err = freeLocalPort()
+		if err != nil {
+			return err
+		}
+		// printed even with --quiet, for scripts to read
+		_, _ = fmt.Fprintf(os.Stderr, "local port: %d\n", params.LocalPort)
+	}
+	if client.report != nil && params.Mode == modePortForward {
+		client.report.LocalPort = params.LocalPort
+	}
+
+	dl.enter("starting the session")
+
+	if params.LocalForward != nil {
+		return client.localForward(ctx, params, instanceId, privateIp)
+	}
+	if client.tunnel != nil && params.Mode == modePortForward {
+		dl.stop()
+		return client.tunnel.listen(ctx, params.LocalPort)
+	}
+
+	err = client.startSession(ctx, params, instanceId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// isFdpass tells whether ssh runs us with ProxyUseFdpass, in which case stdin
+// and stdout are the same socket, through which ssh expects to receive the
+// connected file descriptor instead of the proxied stream.
+func isFdpass(in *os.File, out *os.File) bool {
+	ii, err := in.Stat()
+	if err != nil {
+		return false
+	}
+	oi, err := out.Stat()
+	if err != nil {
+		return false
+	}
+	return ii.Mode()&os.ModeSocket != 0 && os.SameFile(ii, oi)
+}
+
+// interruptibleContext returns a context canceled by SIGINT. It only works
+// until the session starts, as the plugin ignores SIGINT from then on.
+func interruptibleContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	go func() {
+		select {
+		case <-ch:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(ch)
+	}()
+
+	return ctx, cancel
+}
+
+/*
+ * Parse arguments
+ */
+
+const (
+	modeSSH         = "ssh"
+	modePortForward = "port-forward"
+)
+
+type Params struct {
+	Profile    string
+	Region     string
+	SSOLogin   bool
+	FIPS       bool
+	AWSTimeout time.Duration
+	MaxRetries int
+	Mode       string
+	DryRun     bool
+	Output     string
+	// the JSON file to write the started session to
+	SessionFile string
+	// print the plugin command of the started session instead of running it
+	ExpandOnly bool
+	Users      []string
+	DetectUser bool
+	Port       int
+	LocalPort  int
+	PublicKey  string
+	Ephemeral  bool
+	// fail rather than prompt for the MFA code of the profile
+	NoMFAPrompt bool
+	// the file created once the session has started
+	StartedFile string
+	// the file of PublicKey, and the ones to send in turn if it is rejected
+	PublicKeyPath string
+	FallbackKeys  []KeyFile
+	// warn about the private keys readable by others
+	CheckKeyPerms bool
+	// replaces the comment of PublicKey when sent
+	KeyComment string
+	// rely on the key already authorized on the instance
+	NoSendKey bool
+	// and also when sending the key is not allowed
+	FallbackNoSendKey bool
+	// log in by ourselves to forward a local port, rather than being a
+	// ProxyCommand
+	Host         string
+	IdentityFile string
+	LocalForward *ForwardSpec
+	// whether the host key of an unknown host is added to known_hosts,
+	// rather than failing the login
+	AcceptNewHostKey bool
+	// whether Profile is given by --profile, which takes precedence over
+	// the host name, unlike the config file
+	ProfileFlag bool
+	// whether Profile is given by the host name (or the resolver command),
+	// whose region then takes precedence over AWS_REGION
+	ProfileFromHost bool
+	// look up the instance with each of the profiles instead
+	Profiles []string
+	// or have the external command resolve the host name
+	ResolverCommand string
+	// AMI name patterns to OS users, tried before the defaults
+	UserMappings []UserMapping
+	// SSM document, which is checked unless it is the default one
+	DocumentName  string
+	Parameters    map[string][]string
+	CheckDocument bool
+	// custom endpoints, EndpointURL is used for the services without one
+	EndpointURL string
+	SSMEndpoint string
+	EC2Endpoint string
+	// cross-account access
+	AssumeRole      string
+	ExternalId      string
+	RoleSessionName string
+	SessionTags     []Tag
+	SourceIdentity  string
+	// ec2 filter
+	Id        string
+	Names     []string
+	PrivateIp string
+	PublicIp  string
+	Ipv6      string
+	Tags      []Tag
+	// the PrivateDnsName, e.g. ip-10-0-1-23.ec2.internal
+	PrivateDns string
+	// resolved to the instance associated with the Elastic IP
+	AllocationId string
+	// the tag of Name, Name by default
+	NameTagKey string
+	// print the tags of the resolved instance
+	ShowTags bool
+	// and fail unless it has all of these
+	RequiredTags []Tag
+	// profiles of the account IDs in the host name
+	AccountProfiles map[string]string
+	// and of the environment names
+	EnvProfiles map[string]string
+	// placement filters
+	PlacementGroup string
+	HostId         string
+	// instance states to match
+	States []string
+	// wait until a pending instance is running and passes status checks
+	WaitForRunning bool
+	WaitTimeout    time.Duration
+	// and until its SSM agent is online
+	WaitForSSM bool
+	// how long the session may take to be established, 0 for no limit
+	ConnectTimeout time.Duration
+	// how long it may take until the session is started, 0 for no limit
+	Deadline time.Duration
+	// check that the instance is online in SSM before sending the key
+	Preflight bool
+	// choose the most recently launched instance when multiple instances match
+	PickFirst bool
+	// or the least recently launched one
+	PickOldest bool
+	// choose the n-th instance ordered by launch time
+	Index *int
+	// use the private IP of the network interface at this device index
+	EniIndex *int
+	// prompt the user to choose one when multiple instances match
+	Interactive bool
+	// instance cache
+	CacheTTL time.Duration
+	NoCache  bool
+	// audit log of the sessions, with the Name tag of the resolved instance
+	AuditFile    string
+	NoAudit      bool
+	ResolvedName string
+	// statsd endpoint of the metrics
+	MetricsEndpoint string
+	// session-manager-plugin
+	PluginPath             string
+	MinPluginVersion       string
+	SkipPluginVersionCheck bool
+	// speak the data channel protocol instead of the plugin
+	Native bool
+	// the interval of the keep-alive with --native or --local-forward
+	Keepalive time.Duration
+	// the size of the buffers copying the stream by ourselves, the default
+	// of each if zero
+	IOBufferSize int
+	// reach the instance through SSM or an EC2 Instance Connect Endpoint
+	Transport      string
+	EICEEndpointId string
+	// shared AWS config files instead of the default ones
+	AWSConfigFile      string
+	AWSCredentialsFile string
+	// proxy of the AWS API calls and the plugin
+	HTTPSProxy string
+}
+
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// awsOptions are shared by the commands calling AWS APIs.
+type awsOptions struct {
+	Profile         string        `long:"profile" description:"Aws credentials profile name"`
+	ProfileFromEnv  bool          `long:"profile-from-env" description:"Take the profile from AWS_PROFILE if set, as if given by --profile, over the host name and the config file"`
+	Region          string        `long:"region" description:"AWS region"`
+	SSO             bool          `long:"sso-login" description:"Run aws sso login when the SSO session has expired"`
+	FIPS            bool          `long:"fips" description:"Use FIPS endpoints (also enabled by AWS_USE_FIPS_ENDPOINT=true)"`
+	URL             string        `long:"endpoint-url" description:"Custom endpoint URL of all the AWS services"`
+	SSMURL          string        `long:"ssm-endpoint" description:"Custom endpoint URL of SSM"`
+	EC2URL          string        `long:"ec2-endpoint" description:"Custom endpoint URL of EC2 and EC2 Instance Connect"`
+	Role            string        `long:"assume-role" description:"ARN of the IAM role to assume"`
+	ExtId           string        `long:"external-id" description:"External ID used to assume the role"`
+	RoleSN          string        `long:"role-session-name" description:"Session name used to assume the role"`
+	SessionTags     []string      `long:"session-tag" description:"Session tag to assume the role with (key=value, repeatable)"`
+	SourceIdentity  string        `long:"source-identity" description:"Source identity to assume the role with"`
+	ConfigFile      string        `long:"aws-config-file" description:"Shared AWS config file (default: AWS_CONFIG_FILE or ~/.aws/config)"`
+	CredentialsFile string        `long:"aws-credentials-file" description:"Shared AWS credentials file (default: AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials)"`
+	Timeout         time.Duration `long:"aws-timeout" description:"Timeout of each AWS API call" default:"30s"`
+	Retries         int           `long:"max-retries" description:"Maximum number of retries on throttling and transient errors" default:"5"`
+	Proxy           string        `long:"https-proxy" description:"HTTP(S) proxy URL to reach AWS through, also handed to session-manager-plugin (default: HTTPS_PROXY)"`
+
+	// whether --profile is given in the command line, not in the config file
+	profileFlag bool
+}
+
+func (o *awsOptions) apply(p *Params) error {
+	p.Profile = o.Profile
+	p.ProfileFlag = o.profileFlag
+	p.Region = o.Region
+	p.SSOLogin = o.SSO
+	p.FIPS = o.FIPS
+	p.EndpointURL = o.URL
+	p.SSMEndpoint = o.SSMURL
+	p.EC2Endpoint = o.EC2URL
+	p.AssumeRole = o.Role
+	p.ExternalId = o.ExtId
+	p.RoleSessionName = o.RoleSN
+	p.SourceIdentity = o.SourceIdentity
+	p.AWSTimeout = o.Timeout
+	p.MaxRetries = o.Retries
+	p.AWSConfigFile = o.ConfigFile
+	p.AWSCredentialsFile = o.CredentialsFile
+	if o.Proxy != "" {
+		if err := validateProxy(o.Proxy); err != nil {
+			return err
+		}
+		p.HTTPSProxy = o.Proxy
+	}
+	for _, t := range o.SessionTags {
+		k, v, err := parseKeyValue(t)
+		if err != nil {
+			return fmt.Errorf("invalid session tag: %v", err)
+		}
+		p.SessionTags = append(p.SessionTags, Tag{Key: k, Value: v})
+	}
+	if p.AssumeRole == "" && (p.ExternalId != "" || p.RoleSessionName != "" || len(p.SessionTags) > 0 || p.SourceIdentity != "") {
+		return fmt.Errorf("--external-id, --role-session-name, --session-tag and --source-identity require --assume-role")
+	}
+	return validateSessionTags(p.SessionTags, p.SourceIdentity)
+}
+
+// the limits of AssumeRole
+const (
+	maxSessionTags           = 50
+	maxSessionTagKeyLength   = 128
+	maxSessionTagValueLength = 256
+	minSourceIdentityLength  = 2
+	maxSourceIdentityLength  = 64
+)
+
+var (
+	sessionTagPattern     = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+	sourceIdentityPattern = regexp.MustCompile(`^[\w+=,.@-]*$`)
+)
+
+func validateSessionTags(tags []Tag, sourceIdentity string) error {
+	if len(tags) > maxSessionTags {
+		return fmt.Errorf("too many session tags: %d (up to %d)", len(tags), maxSessionTags)
+	}
+	seen := map[string]bool{}
+	for _, t := range tags {
+		if len(t.Key) > maxSessionTagKeyLength || !sessionTagPattern.MatchString(t.Key) {
+			return fmt.Errorf("invalid session tag key: %s", t.Key)
+		}
+		if len(t.Value) > maxSessionTagValueLength || !sessionTagPattern.MatchString(t.Value) {
+			return fmt.Errorf("invalid session tag value: %s=%s", t.Key, t.Value)
+		}
+		// tag keys are case-insensitive
+		k := strings.ToLower(t.Key)
+		if seen[k] {
+			return fmt.Errorf("duplicate session tag: %s", t.Key)
+		}
+		seen[k] = true
+	}
+	if sourceIdentity != "" {
+		n := len(sourceIdentity)
+		if n < minSourceIdentityLength || n > maxSourceIdentityLength || !sourceIdentityPattern.MatchString(sourceIdentity) {
+			return fmt.Errorf("invalid source identity: %s", sourceIdentity)
+		}
+	}
+	return nil
+}
+
+// defaultPattern is the default of --pattern.
+const defaultPattern = "ec2.{name}"
+
+// selectorOptions are shared by the commands looking up instances.
+type selectorOptions struct {
+	Pattern []string `long:"pattern" description:"Host name pattern, tried in order when repeated" default:"ec2.{name}"`
+	Name    []string `long:"name" description:"Filter instances by Name tag, where * and ? are wildcards, matching any of the comma-separated or repeated names"`
+	NameKey string   `long:"name-tag-key" description:"Tag holding the instance name, filtered by {name} and --name" default:"Name"`
+	Id      string   `long:"instance-id" description:"Select the instance by ID, ignoring the host name"`
+	PubIp   string   `long:"public-ip" description:"Select the instance by its public or Elastic IP"`
+	EipId   string   `long:"eip-allocation-id" description:"Select the instance associated with the Elastic IP allocation"`
+	Tags    []string `long:"tag" description:"Filter instances by tag (key=value, repeatable)"`
+	State   string   `long:"state" description:"Comma-separated instance states to match" default:"running"`
+	Asg     string   `long:"asg" description:"Filter instances by Auto Scaling Group name"`
+	Group   string   `long:"placement-group" description:"Filter instances by placement group name"`
+	HostId  string   `long:"host-id" description:"Filter instances by dedicated host ID"`
+	Partial bool     `long:"no-anchor" description:"Allow the pattern to match a part of the host name"`
+	Accts   []string `long:"account-profile" description:"AWS account ID matched by {account} and the profile to use for it (account=profile, repeatable)"`
+	Envs    []string `long:"env-profile" description:"Environment name matched by {env} and the profile to use for it (env=profile, repeatable)"`
+}
+
+var (
+	accountIdPattern = regexp.MustCompile(`^\d{12}$`)
+	envPattern       = regexp.MustCompile(`^[\w-]+$`)
+)
+
+// parseProfileMap parses the key=profile mappings of --account-profile and
+// --env-profile.
+func parseProfileMap(l []string, what string, key *regexp.Regexp) (map[string]string, error) {
+	if len(l) == 0 {
+		return nil, nil
+	}
+	m := map[string]string{}
+	for _, a := range l {
+		k, v, err := parseKeyValue(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s profile: %v", what, err)
+		}
+		if !key.MatchString(k) {
+			return nil, fmt.Errorf("invalid %s: %s", what, k)
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+var instanceIdPattern = regexp.MustCompile(`^i-[0-9a-f]+$`)
+
+// isPrivateDnsName tells whether the host part of a private DNS name, which
+// {privatedns} matches, is an IPv4 address or an instance ID.
+func isPrivateDnsName(s string) bool {
+	host := strings.SplitN(s, ".", 2)[0]
+	if strings.HasPrefix(host, "i-") {
+		return instanceIdPattern.MatchString(host)
+	}
+	ip := net.ParseIP(strings.ReplaceAll(strings.TrimPrefix(host, "ip-"), "-", "."))
+	return ip != nil && ip.To4() != nil
+}
+
+func (o *selectorOptions) apply(p *Params) error {
+	p.Names = nil
+	for _, a := range o.Name {
+		for _, n := range strings.Split(a, ",") {
+			if n = strings.TrimSpace(n); n != "" && !containsString(p.Names, n) {
+				p.Names = append(p.Names, n)
+			}
+		}
+	}
+	p.NameTagKey = o.NameKey
+	if o.Id != "" {
+		if !instanceIdPattern.MatchString(o.Id) {
+			return fmt.Errorf("invalid instance id: %s", o.Id)
+		}
+		p.Id = o.Id
+	}
+	if o.PubIp != "" {
+		if ip := net.ParseIP(o.PubIp); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid public ip address: %s", o.PubIp)
+		}
+		p.PublicIp = o.PubIp
+	}
+	p.AllocationId = o.EipId
+	for _, t := range o.Tags {
+		k, v, err := parseKeyValue(t)
+		if err != nil {
+			return fmt.Errorf("invalid tag filter: %v", err)
+		}
+		p.Tags = append(p.Tags, Tag{Key: k, Value: v})
+	}
+	if o.Asg != "" {
+		p.Tags = append(p.Tags, Tag{Key: "aws:autoscaling:groupName", Value: o.Asg})
+	}
+	p.PlacementGroup = o.Group
+	p.HostId = o.HostId
+	var err error
+	p.AccountProfiles, err = parseProfileMap(o.Accts, "account", accountIdPattern)
+	if err != nil {
+		return err
+	}
+	p.EnvProfiles, err = parseProfileMap(o.Envs, "env", envPattern)
+	if err != nil {
+		return err
+	}
+
+	for _, st := range strings.Split(o.State, ",") {
+		st = strings.TrimSpace(st)
+		if st != "" {
+			p.States = append(p.States, st)
+		}
+	}
+	return nil
+}
+
+// parseHost parses the host name with the patterns, unless the instance is
+// given by --instance-id.
+func (o *selectorOptions) parseHost(hostname string, p *Params) error {
+	if o.Id != "" || o.PubIp != "" || o.EipId != "" {
+		return p.validateSelector()
+	}
+	// with tags, the host name of the default pattern is just a name for
+	// ssh, such as ec2.dummy, rather than the Name tag
+	if (len(o.Tags) > 0 || o.Asg != "") && len(o.Pattern) == 1 && o.Pattern[0] == defaultPattern {
+		return p.validateSelector()
+	}
+	return parseHostname(hostname, o.Pattern, !o.Partial, p)
+}
+
+// hostProfile returns the profile the host name chooses, which selects the
+// profile section of the config file, or "" if it chooses none.
+func (o *selectorOptions) hostProfile(hostname string) string {
+	var p Params
+	if hostname == "" || o.apply(&p) != nil || o.parseHost(hostname, &p) != nil || !p.ProfileFromHost {
+		return ""
+	}
+	return p.Profile
+}
+
+func newParser(command string, opts interface{}) *flags.Parser {
+	parser := flags.NewParser(opts, flags.HelpFlag|flags.PassDoubleDash)
+	if command != "" {
+		parser.Name += " " + command
+	}
+	return parser
+}
+
+// keyOptions select the public key sent with EC2 Instance Connect.
+type keyOptions struct {
+	KeyFile []string `long:"public-key" description:"SSH public key file path, or - to read it from stdin, where the next one is sent if EC2 Instance Connect rejects it when repeated (default: the first of ~/.ssh/id_ed25519.pub, id_ecdsa.pub and id_rsa.pub)"`
+	KeyData string   `long:"public-key-data" description:"SSH public key"`
+	Ephem   bool     `long:"ephemeral" description:"Generate an ephemeral key pair and add it to ssh-agent instead of reading the public key file"`
+	FromAg  bool     `long:"from-agent" description:"Send the first public key in ssh-agent instead of reading the public key file"`
+	AgentC  string   `long:"agent-key-comment" description:"Send the key with this comment in ssh-agent (implies --from-agent)"`
+	NoSend  bool     `long:"no-send-key" description:"Do not send the public key with EC2 Instance Connect, relying on the key already authorized on the instance"`
+	FallNS  bool     `long:"fallback-no-send-key" description:"Connect relying on the key already authorized on the instance when sending the public key is not allowed by IAM"`
+	Perms   string   `long:"check-key-perms" description:"Warn when the private key of the public key file is readable by others, which --check-key-perms=false disables" choice:"true" choice:"false" optional:"yes" optional-value:"true" default:"true"`
+	NoPerms bool     `long:"no-check-key-perms" description:"Same as --check-key-perms=false"`
+	Comment string   `long:"key-comment" description:"Replace the comment of the key sent, or append to it if starting with +, expanding {profile}, {region}, {user} and {time}"`
+}
+
+func parseArgs(args []string) (*Params, error) {
+	ret := Params{}
+
+	var opts struct {
+		Mode   string `long:"mode" description:"Session mode" choice:"ssh" choice:"port-forward" default:"ssh"`
+		DryRun bool   `long:"dry-run" description:"Print the resolved instance and the session-manager-plugin command without connecting"`
+		Output string `long:"output" description:"Also print the instance and the session as JSON, to stderr in ssh mode (or instead of the dry run, to stdout)" choice:"text" choice:"json" default:"text"`
+		StartF string `long:"started-file" description:"Create the file once the session has started, for scripts waiting for the connection"`
+		SessF  string `long:"output-session-file" description:"Write the session ID, its stream URL and token, and the instance to this JSON file once the session has started"`
+		Expand bool   `long:"expand-only" description:"Start the session and print the session-manager-plugin command and its environment as JSON instead of running it, leaving the session to the caller"`
+		Local  *int   `long:"local-port" description:"Local port number to forward in port-forward mode, or 0 for a free one (default: PORT)"`
+		Fwd    string `long:"local-forward" description:"Log in with SSH and forward a local port to a host through the instance ([bind:]port:host:hostport)"`
+		NewKey bool   `long:"accept-new-host-key" description:"With --local-forward, accept the host key of an unknown host and add it to ~/.ssh/known_hosts"`
+
+		Profs  []string `long:"profiles" description:"Comma-separated profiles to look up the instance with, connecting to the only one where it is found"`
+		Resolv string   `long:"resolver-command" description:"Command printing the instance ID, and optionally the region and the profile, for HOST and PORT instead of looking it up by the host name"`
+		configOptions
+		logOptions
+		awsOptions
+		selectorOptions
+		keyOptions
+		User    string   `long:"user" description:"OS user on the EC2 instance, or comma-separated users to send the key for, where {tag:KEY} is the tag of the instance" default:"ec2-user"`
+		Detect  bool     `long:"detect-user" description:"Detect the OS user from the AMI name, falling back to --user"`
+		UserMap []string `long:"user-map" description:"AMI name pattern and its OS user for --detect-user (pattern=user, repeatable)"`
+		DocName string   `long:"document-name" description:"SSM document to start the session with (default: AWS-StartSSHSession, or AWS-StartPortForwardingSession in port-forward mode)"`
+		DocArgs []string `long:"parameter" description:"SSM document parameter (key=value, repeatable)"`
+		DocFile string   `long:"parameter-file" description:"JSON file of SSM document parameters ({\"key\": [\"value\"]}), overridden by --parameter"`
+		First   bool     `long:"pick-first" description:"Choose the most recently launched instance when multiple instances match"`
+		Newest  bool     `long:"newest" description:"Same as --pick-first"`
+		Oldest  bool     `long:"oldest" description:"Choose the least recently launched instance when multiple instances match"`
+		Index   *int     `long:"index" description:"Choose the N-th (0-based) matching instance ordered by launch time"`
+		Eni     *int     `long:"eni-index" description:"Use the private IP of the network interface at device index N, which is forwarded to in port-forward mode"`
+		NoTTY   bool     `long:"no-interactive" description:"Do not prompt to choose an instance when multiple instances match"`
+		Plugin  string   `long:"plugin-path" description:"Path to the session-manager-plugin binary" env:"EC2_SSH_PROXY_PLUGIN_PATH"`
+		MinPV   string   `long:"min-plugin-version" description:"Minimum required session-manager-plugin version" default:"1.1.23.0"` // the first version supporting SSH
+		SkipPV  bool     `long:"skip-plugin-version-check" description:"Do not check the session-manager-plugin version"`
+		Native  bool     `long:"native" description:"Open the SSM data channel by itself without session-manager-plugin (experimental, ssh mode only)"`
+		Trans   string   `long:"transport" description:"Reach the instance through SSM or an EC2 Instance Connect Endpoint" choice:"ssm" choice:"eice" default:"ssm"`
+		EiceId  string   `long:"eice-endpoint-id" description:"EC2 Instance Connect Endpoint for --transport eice (default: the one in the VPC of the instance)"`
+
+		Cache   time.Duration `long:"cache-ttl" description:"How long resolved instances are cached" default:"5m"`
+		NoCache bool          `long:"no-cache" description:"Do not use the instance cache"`
+		Audit   string        `long:"audit-file" description:"Audit log file of the sessions (default: ~/.local/state/ec2-ssh-proxy/audit.log)"`
+		NoAudit bool          `long:"no-audit" description:"Do not write the audit log"`
+		Metrics string        `long:"metrics-endpoint" description:"Send the timings of the AWS API calls and the sessions to statsd (host:port or statsd://host:port)"`
+		Wait    bool          `long:"wait-for-running" description:"Wait until a pending instance is running and passes status checks"`
+		WaitSSM bool          `long:"wait-for-ssm" description:"Wait until the SSM agent of the instance is online"`
+		WaitTO  time.Duration `long:"wait-timeout" description:"Timeout of --wait-for-running and --wait-for-ssm" default:"120s"`
+		ConnTO  time.Duration `long:"connect-timeout" description:"Fail when the SSM session is not established within this time (0 for no limit)" default:"20s"`
+		Deadln  time.Duration `long:"deadline" description:"Fail unless the session is started within this time, from looking up the instance to StartSession (0 for no limit)"`
+		Keep    time.Duration `long:"keepalive" description:"Keep an idle session alive at this interval with --native or --local-forward (default: 5m pings with --native, none with --local-forward)"`
+		IOBuf   int           `long:"io-buffer-size" description:"Size in bytes of the buffers copying the stream with --native, --transport eice or --local-forward (default: 1024 with --native, as session-manager-plugin, 32768 otherwise)"`
+		Preflt  bool          `long:"preflight" description:"Check that the instance is online in SSM before sending the key"`
+		ShowTg  bool          `long:"show-tags" description:"Print the tags of the instance to stderr before connecting"`
+		ReqTag  []string      `long:"require-tag" description:"Fail unless the resolved instance has the tag, unlike --tag filtering instances (key=value, repeatable)"`
+		Args    struct {
+			HOST hostArg `required:"yes"`
+			PORT portArg `required:"yes"`
+			// %r of ssh, which replaces --user
+			USER string
+		} `positional-args:"yes"`
+	}
+	hostProfile := func() string {
+		if opts.Resolv != "" {
+			return ""
+		}
+		return opts.selectorOptions.hostProfile(string(opts.Args.HOST))
+	}
+	err := parseArgsWithConfig(newParser("", &opts), args, &opts, &opts.configOptions, &opts.awsOptions, hostProfile)
+	if err != nil {
+		return nil, err
+	}
+	err = opts.logOptions.apply()
+	if err != nil {
+		return nil, err
+	}
+
+	err = opts.awsOptions.apply(&ret)
+	if err != nil {
+		return nil, err
+	}
+	err = opts.selectorOptions.apply(&ret)
+	if err != nil {
+		return nil, err
+	}
+
+	ret.Mode = opts.Mode
+	for _, a := range opts.Profs {
+		for _, p := range strings.Split(a, ",") {
+			if p = strings.TrimSpace(p); p != "" && !containsString(ret.Profiles, p) {
+				ret.Profiles = append(ret.Profiles, p)
+			}
+		}
+	}
+	if len(ret.Profiles) > 0 && ret.ProfileFlag {
+		return nil, fmt.Errorf("--profiles can not be used with --profile")
+	}
+	ret.DryRun = opts.DryRun
+	ret.Output = opts.Output
+	ret.StartedFile = opts.StartF
+	ret.SessionFile = opts.SessF
+	ret.ExpandOnly = opts.Expand
+	ret.PluginPath = opts.Plugin
+	ret.MinPluginVersion = opts.MinPV
+	ret.SkipPluginVersionCheck = opts.SkipPV
+	ret.Native = opts.Native
+	if ret.Native && ret.Mode != modeSSH {
+		return nil, fmt.Errorf("--native is only supported in ssh mode")
+	}
+	ret.Keepalive = opts.Keep
+	ret.IOBufferSize = opts.IOBuf
+	ret.Transport = opts.Trans
+	ret.EICEEndpointId = opts.EiceId
+	if ret.Transport == transportEICE && (ret.Native || opts.Preflt || opts.WaitSSM || ret.SessionFile != "") {
+		return nil, fmt.Errorf("--native, --preflight, --wait-for-ssm and --output-session-file can not be used with --transport eice")
+	}
+	if ret.HTTPSProxy != "" && (ret.Native || ret.Transport == transportEICE) {
+		logger.Warnf("the websocket of --native and --transport eice does not go through --https-proxy")
+	}
+	if ret.EICEEndpointId != "" && ret.Transport != transportEICE {
+		return nil, fmt.Errorf("--eice-endpoint-id requires --transport eice")
+	}
+	if !versionPattern.MatchString(ret.MinPluginVersion) {
+		return nil, fmt.Errorf("invalid session-manager-plugin version: %s", ret.MinPluginVersion)
+	}
+	users := opts.User
+	if opts.Args.USER != "" {
+		users = opts.Args.USER
+	}
+	for _, u := range strings.Split(users, ",") {
+		u = strings.TrimSpace(u)
+		if u != "" {
+			ret.Users = append(ret.Users, u)
+		}
+	}
+	if len(ret.Users) == 0 {
+		return nil, fmt.Errorf("no OS user is specified")
+	}
+	ret.DetectUser = opts.Detect
+	ret.UserMappings, err = parseUserMappings(opts.UserMap)
+	if err != nil {
+		return nil, err
+	}
+	ret.Host = string(opts.Args.HOST)
+	ret.Port = int(opts.Args.PORT)
+	ret.LocalPort = ret.Port
+	if opts.Local != nil {
+		if *opts.Local < 0 || *opts.Local > 65535 {
+			return nil, fmt.Errorf("invalid local port number: %d", *opts.Local)
+		}
+		ret.LocalPort = *opts.Local
+	}
+	ret.PickFirst = opts.First || opts.Newest
+	ret.PickOldest = opts.Oldest
+	if ret.PickFirst && ret.PickOldest {
+		return nil, fmt.Errorf("--newest (or --pick-first) and --oldest can not be specified at same time")
+	}
+	ret.Index = opts.Index
+	ret.EniIndex = opts.Eni
+	ret.Interactive = !opts.NoTTY && !logger.quiet() && isTerminal(os.Stdin)
+	ret.CacheTTL = opts.Cache
+	ret.NoCache = opts.NoCache
+	ret.AuditFile = opts.Audit
+	ret.NoAudit = opts.NoAudit
+	ret.MetricsEndpoint = opts.Metrics
+	if ret.MetricsEndpoint != "" {
+		if _, err := metricsAddress(ret.MetricsEndpoint); err != nil {
+			return nil, err
+		}
+	}
+	ret.WaitForRunning = opts.Wait
+	ret.WaitForSSM = opts.WaitSSM
+	ret.WaitTimeout = opts.WaitTO
+	ret.ConnectTimeout = opts.ConnTO
+	ret.Deadline = opts.Deadln
+	ret.Preflight = opts.Preflt
+	ret.ShowTags = opts.ShowTg
+	for _, t := range opts.ReqTag {
+		k, v, err := parseKeyValue(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid required tag: %v", err)
+		}
+		ret.RequiredTags = append(ret.RequiredTags, Tag{Key: k, Value: v})
+	}
+	if ret.WaitForRunning && len(ret.States) > 0 && !containsString(ret.States, "pending") {
+		ret.States = append(ret.States, "pending")
+	}
+
+	ret.DocumentName = opts.DocName
+	ret.CheckDocument = opts.DocName != ""
+	if ret.DocumentName == "" {
+		if ret.Mode == modePortForward {
+			ret.DocumentName = "AWS-StartPortForwardingSession"
+		} else {
+			ret.DocumentName = "AWS-StartSSHSession"
+		}
+	}
+	ret.Parameters = map[string][]string{}
+	for _, a := range opts.DocArgs {
+		k, v, err := parseKeyValue(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid document parameter: %v", err)
+		}
+		ret.Parameters[k] = append(ret.Parameters[k], v)
+	}
+	if opts.DocFile != "" {
+		file, err := readParameterFile(opts.DocFile)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range file {
+			if _, ok := ret.Parameters[k]; !ok {
+				ret.Parameters[k] = v
+			}
+		}
+	}
+
+	// read SSH public key
+	ret.Ephemeral = opts.Ephem
+	ret.KeyComment = opts.Comment
+	n := 0
+	fromAgent := opts.FromAg || opts.AgentC != ""
+	for _, set := range []bool{len(opts.KeyFile) > 0, opts.KeyData != "", opts.Ephem, fromAgent} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return nil, fmt.Errorf("only one of --public-key, --public-key-data, --ephemeral and --from-agent can be specified")
+	}
+	if len(opts.KeyFile) > 1 && containsString(opts.KeyFile, "-") {
+		return nil, fmt.Errorf("--public-key - can not be repeated")
+	}
+	ret.NoSendKey = opts.NoSend
+	ret.FallbackNoSendKey = opts.FallNS
+	if ret.NoSendKey && ret.FallbackNoSendKey {
+		return nil, fmt.Errorf("--fallback-no-send-key can not be used with --no-send-key")
+	}
+	ret.CheckKeyPerms = ret.Mode == modeSSH && opts.Perms == "true" && !opts.NoPerms
+	if ret.NoSendKey && (len(opts.KeyFile) > 1 || opts.KeyData != "" || opts.Ephem || fromAgent || opts.Comment != "") {
+		return nil, fmt.Errorf("--no-send-key can not be used with the options of the key to send")
+	}
+	switch {
+	case ret.Mode == modePortForward:
+		// no SSH key is needed
+	case ret.NoSendKey:
+		// the key already authorized on the instance is used
+		if len(opts.KeyFile) > 0 && opts.KeyFile[0] != "-" {
+			ret.IdentityFile = privateKeyPath(opts.KeyFile[0])
+		} else if k, kerr := findDefaultPublicKey(); kerr == nil {
+			ret.IdentityFile = privateKeyPath(k)
+		}
+	case opts.Ephem:
+		// generated right before it is sent
+	case fromAgent:
+		ret.PublicKey, err = readAgentPublicKey(opts.AgentC)
+	case opts.KeyData != "":
+		ret.PublicKey = opts.KeyData
+		err = validatePublicKey([]byte(ret.PublicKey))
+	case len(opts.KeyFile) == 1 && opts.KeyFile[0] == "-":
+		ret.PublicKey, err = readPublicKeyFrom(os.Stdin)
+	case len(opts.KeyFile) > 0:
+		var keys []KeyFile
+		keys, err = readKeyFiles(opts.KeyFile)
+		if err == nil {
+			ret.useKeyFile(keys[0])
+			ret.FallbackKeys = keys[1:]
+		}
+	default:
+		var k string
+		k, err = findDefaultPublicKey()
+		if err == nil {
+			ret.PublicKey, err = readPublicKey(k)
+			ret.PublicKeyPath = k
+			ret.IdentityFile = privateKeyPath(k)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Fwd != "" {
+		if ret.Mode != modeSSH {
+			return nil, fmt.Errorf("--local-forward can not be used in %s mode", ret.Mode)
+		}
+		ret.LocalForward, err = parseForwardSpec(opts.Fwd)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ret.AcceptNewHostKey = opts.NewKey
+	if ret.AcceptNewHostKey && ret.LocalForward == nil {
+		logger.Warnf("--accept-new-host-key only applies with --local-forward")
+	}
+	if ret.Keepalive > 0 && !ret.Native && ret.LocalForward == nil {
+		// the plugin has no such setting, but ssh does
+		logger.Warnf("--keepalive only applies with --native or --local-forward, set ServerAliveInterval of ssh instead")
+	}
+	if ret.ExpandOnly && (ret.DryRun || ret.Native || ret.Transport == transportEICE || ret.LocalForward != nil) {
+		// there is no plugin command to print, or we need the session
+		return nil, fmt.Errorf("--expand-only can not be used with --dry-run, --native, --transport eice or --local-forward")
+	}
+	if ret.IOBufferSize != 0 && (ret.IOBufferSize < minIOBufferSize || ret.IOBufferSize > maxIOBufferSize) {
+		return nil, fmt.Errorf("--io-buffer-size must be between %d and %d", minIOBufferSize, maxIOBufferSize)
+	}
+	if ret.IOBufferSize != 0 && !ret.Native && ret.Transport != transportEICE && ret.LocalForward == nil {
+		// the stdio is handed over to the plugin as is
+		logger.Warnf("--io-buffer-size only applies with --native, --transport eice or --local-forward")
+	}
+
+	ret.ResolverCommand = opts.Resolv
+	if ret.ResolverCommand != "" {
+		if ret.Id != "" || ret.PublicIp != "" || ret.AllocationId != "" || len(ret.Profiles) > 0 {
+			return nil, fmt.Errorf("--resolver-command can not be used with --instance-id, --public-ip, --eip-allocation-id or --profiles")
+		}
+	} else {
+		err = opts.selectorOptions.parseHost(string(opts.Args.HOST), &ret)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ret.resolveProfile()
+
+	// forward to the address of the interface rather than to localhost
+	if ret.EniIndex != nil && ret.Mode == modePortForward && opts.DocName == "" {
+		ret.DocumentName = "AWS-StartPortForwardingSessionToRemoteHost"
+	}
+
+	return &ret, nil
+}
+
+const (
+	minIOBufferSize = 512
+	maxIOBufferSize = 1 << 20
+)
+
+// copyBuffer copies src to dst through a buffer of the size, or of the
+// default of io.Copy if zero. Unlike io.CopyBuffer, the buffer is used even
+// with a file, which would otherwise copy with a buffer of its own.
+func copyBuffer(dst io.Writer, src io.Reader, size int) (int64, error) {
+	if size <= 0 {
+		return io.Copy(dst, src)
+	}
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, make([]byte, size))
+}
+
+func containsString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func parseKeyValue(s string) (string, string, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return "", "", fmt.Errorf("%s (expected key=value)", s)
+	}
+	return kv[0], kv[1], nil
+}
+
+// parseHostname tries the patterns in order, and takes the first one that
+// matches the host name and yields a valid selector.
+func parseHostname(hostname string, patterns []string, anchor bool, p *Params) error {
+	var lastErr error
+	for _, pattern := range patterns {
+		q := *p
+		ok, err := matchHostname(hostname, pattern, anchor, &q)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		lastErr = q.validateSelector()
+		if lastErr == nil {
+			*p = q
+			return nil
+		}
+	}
+	if lastErr != nil {
+		return lastErr
+	}
+
+	// the host name does not have to match when selected by tags
+	if p.validateSelector() == nil {
+		return nil
+	}
+	return fmt.Errorf("host name %s does not match any of the patterns: %s", hostname, strings.Join(patterns, ", "))
+}
+
+func expandPattern(pattern string) string {
+	pat := pattern
+	pat = strings.ReplaceAll(pat, "{name}", `(?P<name>[\w*?-]+)`)
+	pat = strings.ReplaceAll(pat, "{id}", `(?P<id>[\w-]+)`)
+	pat = strings.ReplaceAll(pat, "{profile}", `(?P<profile>[\w-]+)`)
+	pat = strings.ReplaceAll(pat, "{region}", `(?P<region>[\w-]+)`)
+	pat = strings.ReplaceAll(pat, "{account}", `(?P<account>\d{12})`)
+	pat = strings.ReplaceAll(pat, "{env}", `(?P<env>[\w-]+)`)
+	pat = strings.ReplaceAll(pat, "{ip}", `(?P<ip>\d+[-.]\d+[-.]\d+[-.]\d+)`)
+	pat = strings.ReplaceAll(pat, "{privateip}", `(?P<ip>\d+[-.]\d+[-.]\d+[-.]\d+)`)
+	pat = strings.ReplaceAll(pat, "{publicip}", `(?P<publicip>\d+[-.]\d+[-.]\d+[-.]\d+)`)
+	// colons are not allowed in host names, so : may be written as -
+	pat = strings.ReplaceAll(pat, "{ipv6}", `(?P<ipv6>[0-9a-fA-F]{0,4}(?:[-:][0-9a-fA-F]{0,4}){2,7})`)
+	pat = strings.ReplaceAll(pat, "{eni}", `(?P<eni>\d+)`)
+	// the IP or the resource name, followed by the domain of the region
+	pat = strings.ReplaceAll(pat, "{privatedns}", `(?P<privatedns>(?:ip-[\d-]+|i-[0-9a-f]+)\.(?:ec2|[a-z0-9-]+\.compute)\.internal)`)
+	return pat
+}
+
+// profileMapString lists the mappings for an error message.
+func profileMapString(m map[string]string, what string) string {
+	if len(m) == 0 {
+		return fmt.Sprintf("no %s is mapped", what)
+	}
+	var l []string
+	for k, v := range m {
+		l = append(l, k+"="+v)
+	}
+	sort.Strings(l)
+	return "mapped: " + strings.Join(l, ", ")
+}
+
+// availableProfiles lists the profiles of the shared files to map with.
+func availableProfiles(p *Params) string {
+	profiles := sharedProfiles(p)
+	if len(profiles) == 0 {
+		return ""
+	}
+	return " with one of the profiles: " + strings.Join(profiles, ", ")
+}
+
+// compiledPattern is the regexp the pattern is expanded to.
+func compiledPattern(pattern string, anchor bool) string {
+	pat := expandPattern(pattern)
+	if anchor {
+		pat = "^(?:" + pat + ")$"
+	}
+	return pat
+}
+
+func matchHostname(hostname string, pattern string, anchor bool, p *Params) (bool, error) {
+	re, err := regexp.Compile(compiledPattern(pattern, anchor))
+	if err != nil {
+		return false, fmt.Errorf("invalid host name pattern: %s", pattern)
+	}
+
+	keys := re.SubexpNames()
+	vals := re.FindStringSubmatch(hostname)
+	if vals == nil {
+		return false, nil
+	}
+	for i, k := range keys {
+		v := vals[i]
+		// the --name option takes precedence
+		if k == "name" && len(p.Names) == 0 {
+			p.Names = []string{v}
+		}
+		if k == "id" {
+			p.Id = v
+		}
+		// the --profile option takes precedence, but the profile in the
+		// config file does not
+		if k == "profile" && v != "" && !p.ProfileFlag {
+			p.Profile = v
+			p.ProfileFromHost = true
+		}
+		// likewise, the profile is the one mapped to the account
+		if k == "account" && v != "" && !p.ProfileFlag {
+			profile, ok := p.AccountProfiles[v]
+			if !ok {
+				return false, fmt.Errorf("no profile is mapped to account %s of host name %s (%s), add --account-profile %s=PROFILE%s",
+					v, hostname, profileMapString(p.AccountProfiles, "account"), v, availableProfiles(p))
+			}
+			p.Profile = profile
+			p.ProfileFromHost = true
+		}
+		if k == "env" && v != "" && !p.ProfileFlag {
+			profile, ok := p.EnvProfiles[v]
+			if !ok {
+				return false, fmt.Errorf("no profile is mapped to env %s of host name %s (%s), add --env-profile %s=PROFILE",
+					v, hostname, profileMapString(p.EnvProfiles, "env"), v)
+			}
+			p.Profile = profile
+			p.ProfileFromHost = true
+		}
+		// the --region option takes precedence
+		if k == "region" && p.Region == "" {
+			p.Region = v
+		}
+		if k == "ip" && v != "" {
+			ip := strings.ReplaceAll(v, "-", ".")
+			if net.ParseIP(ip) == nil {
+				return false, fmt.Errorf("invalid private ip address: %s", v)
+			}
+			p.PrivateIp = ip
+		}
+		if k == "publicip" && v != "" {
+			ip := strings.ReplaceAll(v, "-", ".")
+			if net.ParseIP(ip) == nil {
+				return false, fmt.Errorf("invalid public ip address: %s", v)
+			}
+			p.PublicIp = ip
+		}
+		if k == "privatedns" && v != "" {
+			if !isPrivateDnsName(v) {
+				return false, fmt.Errorf("invalid private dns name: %s", v)
+			}
+			p.PrivateDns = v
+		}
+		if k == "ipv6" && v != "" {
+			ip := strings.ReplaceAll(v, "-", ":")
+			if a := net.ParseIP(ip); a == nil || a.To4() != nil {
+				return false, fmt.Errorf("invalid ipv6 address: %s", v)
+			}
+			p.Ipv6 = ip
+		}
+		// the --eni-index option takes precedence
+		if k == "eni" && v != "" && p.EniIndex == nil {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return false, fmt.Errorf("invalid network interface index: %s", v)
+			}
+			p.EniIndex = &n
+		}
+	}
+
+	return true, nil
+}
+
+// nameTagKey returns the tag holding the instance name.
+func (p *Params) nameTagKey() string {
+	if p.NameTagKey == "" {
+		return "Name"
+	}
+	return p.NameTagKey
+}
+
+func (p *Params) validateSelector() error {
+	var selectors []string
+	if len(p.Names) > 0 {
+		selectors = append(selectors, "name")
+	}
+	if p.Id != "" {
+		selectors = append(selectors, "id")
+	}
+	if p.PrivateIp != "" {
+		selectors = append(selectors, "private ip")
+	}
+	if p.PublicIp != "" {
+		selectors = append(selectors, "public ip")
+	}
+	if p.AllocationId != "" {
+		selectors = append(selectors, "eip allocation id")
+	}
+	if p.Ipv6 != "" {
+		selectors = append(selectors, "ipv6")
+	}
+	if p.PrivateDns != "" {
+		selectors = append(selectors, "private dns name")
+	}
+
+	if len(selectors) > 1 {
+		return fmt.Errorf("%s could not be specified at same time", strings.Join(selectors, " and "))
+	}
+	if len(selectors) == 0 && len(p.Tags) == 0 && p.PlacementGroup == "" && p.HostId == "" {
+		return fmt.Errorf("no instance selector is specified (name, id, private ip, public ip, eip allocation id, ipv6, private dns name, tag, asg, placement group or host id)")
+	}
+
+	return nil
+}
+
+/*
+ * AWS client
+ */
+
+type Client struct {
+	ec2   ec2iface.EC2API
+	ec2ic ec2instanceconnectiface.EC2InstanceConnectAPI
+	ssm   ssmiface.SSMAPI
+	sts   stsiface.STSAPI
+
+	credentials *credentials.Credentials
+	timeout     time.Duration
+	region      string
+	cache       *InstanceCache
+	audit       *AuditLog
+	metrics     *Metrics
+	report      *Report
+	tunnel      *eiceTunnel
+	deadline    *deadline
+	skew        clockSkew
+
+	ssmSigningRegion string
+	ssmEndpoint      string
+	plugin           SessionManagerPlugin
+}
+
+func newClient(params *Params) (*Client, error) {
+	c := Client{}
+
+	sess, err := newSession(params)
+	if err != nil {
+		return nil, err
+	}
+	c.credentials = sess.Config.Credentials
+	c.timeout = params.AWSTimeout
+	c.region = aws.StringValue(sess.Config.Region)
+	logger.SetField("profile", params.Profile)
+	logger.SetField("region", c.region)
+	c.cache = newInstanceCache(params)
+	c.audit = newAuditLog(params)
+	c.metrics = newMetrics(params)
+	if c.metrics != nil {
+		sess.Handlers.Complete.PushBack(c.metrics.request)
+	}
+	e := ec2.New(sess, endpointConfig(params.EC2Endpoint, params.EndpointURL))
+	c.ec2 = e
+	ic := ec2instanceconnect.New(sess, endpointConfig(params.EC2Endpoint, params.EndpointURL))
+	c.ec2ic = ic
+	st := sts.New(sess, endpointConfig(params.EndpointURL))
+	c.sts = st
+
+	// the plugin connects to the same, possibly custom, SSM endpoint
+	s := ssm.New(sess, endpointConfig(params.SSMEndpoint, params.EndpointURL))
+	c.ssm = s
+	c.ssmSigningRegion = s.SigningRegion
+	c.ssmEndpoint = s.Endpoint
+
+	for _, h := range []*request.Handlers{&e.Handlers, &ic.Handlers, &st.Handlers, &s.Handlers} {
+		c.skew.install(h)
+	}
+
+	if params.Native {
+		c.plugin = nativePlugin{keepalive: params.Keepalive, bufferSize: params.IOBufferSize}
+	} else {
+		c.plugin = newSessionManagerPlugin(params)
+	}
+
+	return &c, nil
+}
+
+// endpointConfig returns the config overriding the endpoint with the first
+// non-empty one.
+func endpointConfig(urls ...string) *aws.Config {
+	cfg := &aws.Config{}
+	for _, u := range urls {
+		if u != "" {
+			cfg.Endpoint = aws.String(u)
+			break
+		}
+	}
+	return cfg
+}
+
+// call calls an AWS API with the timeout applied. When AWS rejects the
+// request signature as the local clock is skewed, it is called again signed
+// with the time of AWS, as are the later calls.
+func (c *Client) call(ctx context.Context, f func(ctx aws.Context) error) error {
+	err := c.callWithTimeout(ctx, f)
+	if err == nil || !isSignatureError(err) {
+		return err
+	}
+	if c.skew.skewed() && c.skew.adjust() {
+		skew, _ := c.skew.offset()
+		logger.Warnf("the system clock is %s off from AWS, retrying with the time of AWS", absDuration(skew))
+		err = c.callWithTimeout(ctx, f)
+		if err == nil || !isSignatureError(err) {
+			return err
+		}
+	}
+	return c.skew.hint(err)
+}
+
+func (c *Client) callWithTimeout(ctx context.Context, f func(ctx aws.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	err := f(ctx)
+	if err != nil {
+		switch ctx.Err() {
+		case context.DeadlineExceeded:
+			return fmt.Errorf("AWS API call timed out after %s", c.timeout)
+		case context.Canceled:
+			return fmt.Errorf("interrupted")
+		}
+	}
+	return err
+}
+
+func (c *Client) findInstance(ctx context.Context, params *Params) (*ec2.Instance, error) {
+	key := newCacheKey(params, c.region)
+	if c.cache != nil {
+		if i := c.cache.get(key); i != nil {
+			logger.Infof("using the cached instance %s", aws.StringValue(i.InstanceId))
+			return i, nil
+		}
+	}
+
+	lookup, err := c.withAllocation(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	instances, err := c.describeInstances(ctx, newDescribeInstancesInput(lookup, params.States))
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, c.instanceNotFound(ctx, lookup)
+	}
+
+	// an instance chosen interactively is not cached, so that the user is
+	// asked again next time
+	cacheable := len(instances) == 1 || params.Index != nil || params.PickFirst || params.PickOldest
+	i, err := selectInstance(ctx, params, instances)
+	if err != nil {
+		return nil, err
+	}
+	if i.InstanceId == nil {
+		return nil, fmt.Errorf("DescribeInstances returned an instance without the instance ID")
+	}
+	if params.WaitForRunning {
+		i, err = c.waitForRunning(ctx, params, i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.cache != nil && cacheable {
+		c.cache.put(key, i)
+	}
+	return i, nil
+}
+
+// forgetInstance drops the cached instance when err tells it is gone or no
+// longer reachable.
+func (c *Client) forgetInstance(params *Params, err error) {
+	if c.cache == nil {
+		return
+	}
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return
+	}
+	switch aerr.Code() {
+	case ec2instanceconnect.ErrCodeEC2InstanceNotFoundException,
+		ec2instanceconnect.ErrCodeEC2InstanceStateInvalidException,
+		ssm.ErrCodeInvalidInstanceId,
+		ssm.ErrCodeInvalidTarget,
+		ssm.ErrCodeTargetNotConnected:
+		logger.Infof("removing the instance from the cache: %s", aerr.Code())
+		c.cache.delete(newCacheKey(params, c.region))
+	}
+}
+
+func (c *Client) describeInstances(ctx context.Context, in *ec2.DescribeInstancesInput) ([]*ec2.Instance, error) {
+	logValue("DescribeInstances input", in)
+	// a broad filter may match the instance on a later page
+	var ret []*ec2.Instance
+	pages := 0
+	err := c.call(ctx, func(ctx aws.Context) error {
+		return c.ec2.DescribeInstancesPagesWithContext(ctx, in, func(out *ec2.DescribeInstancesOutput, last bool) bool {
+			pages++
+			for _, r := range out.Reservations {
+				ret = append(ret, r.Instances...)
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("DescribeInstances returned %d instances in %d pages", len(ret), pages)
+	return ret, nil
+}
+
+// instanceNotFound looks up the instance again regardless of its state,
+// so that the error can tell a stopped instance from a missing one.
+func (c *Client) instanceNotFound(ctx context.Context, params *Params) error {
+	if params.PublicIp != "" {
+		if err := c.unassociatedAddress(ctx, params.PublicIp); err != nil {
+			return err
+		}
+	}
+	if len(params.States) == 0 {
+		return errInstanceNotFound
+	}
+
+	instances, err := c.describeInstances(ctx, newDescribeInstancesInput(params, nil))
+	if err != nil {
+		return err
+	}
+	if len(instances) == 0 {
+		return errInstanceNotFound
+	}
+
+	state := instanceState(instances[0])
+	return fmt.Errorf("instance found but state is '%s'", state)
+}
+
+// waitForRunning waits until the instance is running and its status checks
+// have passed, and returns the instance looked up again.
+func (c *Client) waitForRunning(ctx context.Context, params *Params, i *ec2.Instance) (*ec2.Instance, error) {
+	id := aws.StringValue(i.InstanceId)
+	logger.Infof("waiting for %s to be running (state: %s)", id, instanceState(i))
+
+	ctx, cancel := context.WithTimeout(ctx, params.WaitTimeout)
+	defer cancel()
+	opts := []request.WaiterOption{
+		request.WithWaiterDelay(request.ConstantWaiterDelay(5 * time.Second)),
+		request.WithWaiterMaxAttempts(0), // bounded by the timeout
+	}
+	err := c.ec2.WaitUntilInstanceRunningWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(id)},
+	}, opts...)
+	if err == nil {
+		err = c.ec2.WaitUntilInstanceStatusOkWithContext(ctx, &ec2.DescribeInstanceStatusInput{
+			InstanceIds: []*string{aws.String(id)},
+		}, opts...)
+	}
+	if err != nil {
+		return nil, c.waitFailed(ctx, params, id, err)
+	}
+
+	// the state and the addresses have changed since it was pending
+	instances, err := c.describeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []*string{aws.String(id)}})
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, errInstanceNotFound
+	}
+	return instances[0], nil
+}
+
+// waitFailed reports the last observed state of the instance.
+func (c *Client) waitFailed(ctx context.Context, params *Params, id string, err error) error {
+	if ctx.Err() == context.Canceled {
+		return fmt.Errorf("interrupted")
+	}
+
+	state := "unknown"
+	instances, derr := c.describeInstances(context.Background(), &ec2.DescribeInstancesInput{InstanceIds: []*string{aws.String(id)}})
+	if derr == nil && len(instances) > 0 {
+		state = instanceState(instances[0])
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s waiting for %s to be running (state: %s)", params.WaitTimeout, id, state)
+	}
+	return fmt.Errorf("failed waiting for %s to be running (state: %s): %v", id, state, err)
+}
+
+func selectInstance(ctx context.Context, params *Params, instances []*ec2.Instance) (*ec2.Instance, error) {
+	// oldest first
+	sort.SliceStable(instances, func(i, j int) bool {
+		return aws.TimeValue(instances[i].LaunchTime).Before(aws.TimeValue(instances[j].LaunchTime))
+	})
+
+	if params.Index != nil {
+		n := *params.Index
+		if n < 0 || n >= len(instances) {
+			return nil, fmt.Errorf("index %d is out of range (%d instances match)", n, len(instances))
+		}
+		return instances[n], nil
+	}
+	if len(instances) == 1 {
+		return instances[0], nil
+	}
+	if params.PickFirst || params.PickOldest {
+		i, which := instances[len(instances)-1], "newest"
+		if params.PickOldest {
+			i, which = instances[0], "oldest"
+		}
+		logger.Infof("chose %s, the %s of %d instances, launched at %s", aws.StringValue(i.InstanceId), which,
+			len(instances), aws.TimeValue(i.LaunchTime).Format(time.RFC3339))
+		return i, nil
+	}
+	if params.Interactive {
+		return pickInstance(ctx, instances, params.nameTagKey())
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d instances match (use --newest, --oldest or --index to choose one):", len(instances))
+	for n, i := range instances {
+		fmt.Fprintf(&b, "\n  [%d] %s\t%s\t%s",
+			n,
+			aws.StringValue(i.InstanceId),
+			aws.StringValue(i.PrivateIpAddress),
+			aws.TimeValue(i.LaunchTime).Format(time.RFC3339))
+	}
+	return nil, errors.New(b.String())
+}
+
+// privateIps returns the private IPs of all the network interfaces ordered by
+// device index, the primary IP of each interface first.
+func privateIps(i *ec2.Instance) []string {
+	interfaces := append([]*ec2.InstanceNetworkInterface{}, i.NetworkInterfaces...)
+	sort.SliceStable(interfaces, func(a, b int) bool {
+		return deviceIndex(interfaces[a]) < deviceIndex(interfaces[b])
+	})
+
+	var ret []string
+	for _, n := range interfaces {
+		primary := aws.StringValue(n.PrivateIpAddress)
+		ret = append(ret, primary)
+		for _, a := range n.PrivateIpAddresses {
+			if ip := aws.StringValue(a.PrivateIpAddress); ip != primary {
+				ret = append(ret, ip)
+			}
+		}
+	}
+	if len(ret) == 0 && i.PrivateIpAddress != nil {
+		ret = append(ret, aws.StringValue(i.PrivateIpAddress))
+	}
+	return ret
+}
+
+func deviceIndex(n *ec2.InstanceNetworkInterface) int64 {
+	if n.Attachment == nil {
+		return -1
+	}
+	return aws.Int64Value(n.Attachment.DeviceIndex)
+}
+
+// privateIpFor returns the primary private IP of the network interface
+// chosen by --eni-index, or that of the instance.
+func privateIpFor(params *Params, i *ec2.Instance) (string, error) {
+	if params.EniIndex == nil {
+		return aws.StringValue(i.PrivateIpAddress), nil
+	}
+	for _, n := range i.NetworkInterfaces {
+		if deviceIndex(n) == int64(*params.EniIndex) {
+			return aws.StringValue(n.PrivateIpAddress), nil
+		}
+	}
+	return "", fmt.Errorf("instance %s has no network interface at device index %d (%d attached)",
+		aws.StringValue(i.InstanceId), *params.EniIndex, len(i.NetworkInterfaces))
+}
+
+func newDescribeInstancesInput(params *Params, states []string) *ec2.DescribeInstancesInput {
+	in := ec2.DescribeInstancesInput{}
+	// EC2 matches * and ? in filter values as wildcards, so that a name
+	// like web-* may match several instances, as do several names
+	if len(params.Names) > 0 {
+		in.Filters = []*ec2.Filter{
+			{
+				Name:   aws.String("tag:" + params.nameTagKey()),
+				Values: aws.StringSlice(params.Names),
+			},
+		}
+	}
+	if params.PrivateIp != "" {
+		in.Filters = append(in.Filters, &ec2.Filter{
+			Name:   aws.String("private-ip-address"),
+			Values: []*string{aws.String(params.PrivateIp)},
+		})
+	}
+	if params.PublicIp != "" {
+		in.Filters = append(in.Filters, &ec2.Filter{
+			Name:   aws.String("ip-address"),
+			Values: []*string{aws.String(params.PublicIp)},
+		})
+	}
+	if params.Ipv6 != "" {
+		in.Filters = append(in.Filters, &ec2.Filter{
+			Name:   aws.String("ipv6-address"),
+			Values: []*string{aws.String(params.Ipv6)},
+		})
+	}
+	if params.PrivateDns != "" {
+		in.Filters = append(in.Filters, &ec2.Filter{
+			Name:   aws.String("private-dns-name"),
+			Values: []*string{aws.String(params.PrivateDns)},
+		})
+	}
+	for _, t := range params.Tags {
+		in.Filters = append(in.Filters, &ec2.Filter{
+			Name:   aws.String("tag:" + t.Key),
+			Values: []*string{aws.String(t.Value)},
+		})
+	}
+	if params.PlacementGroup != "" {
+		in.Filters = append(in.Filters, &ec2.Filter{
+			Name:   aws.String("placement-group-name"),
+			Values: []*string{aws.String(params.PlacementGroup)},
+		})
+	}
+	if params.HostId != "" {
+		in.Filters = append(in.Filters, &ec2.Filter{
+			Name:   aws.String("placement-host-id"),
+			Values: []*string{aws.String(params.HostId)},
+		})
+	}
+	if len(states) > 0 {
+		in.Filters = append(in.Filters, &ec2.Filter{
+			Name:   aws.String("instance-state-name"),
+			Values: aws.StringSlice(states),
+		})
+	}
+	if params.Id != "" {
+		in.InstanceIds = []*string{
+			aws.String(params.Id),
+		}
+	}
+	return &in
+}
+
+// sendPublicKey sends the key for each OS user, so that ssh can log in as
+// any of them. It only fails when the key could not be sent for any user.
+func (c *Client) sendPublicKey(ctx context.Context, params *Params, instanceId string, availabilityZone string) error {
+	if availabilityZone == "" {
+		return fmt.Errorf("the availability zone of %s is unknown, which is required to send the key (use --no-send-key if the key is already authorized)", instanceId)
 	}
-
-	client := newClient(params.Profile)
-
-	err = client.checkPlugin()
-	if err != nil {
-		return err
+	var errs []string
+	for _, user := range params.Users {
+		err := c.sendAcceptedKey(ctx, params, instanceId, availabilityZone, user)
+		if isAccessDenied(err) {
+			// the same for all the users
+			return &SendKeyDeniedError{Err: err}
+		}
+		if err != nil {
+			c.forgetInstance(params, err)
+			if len(params.Users) == 1 || ctx.Err() != nil {
+				return err
+			}
+			logger.Warnf("failed to send the SSH public key for %s: %v", user, err)
+			errs = append(errs, user)
+			continue
+		}
+		logger.Infof("sent the SSH public key for %s", user)
+		logger.Event("info", "key_sent", "instance_id", instanceId, "user", user)
 	}
-
-	instanceId, availabilityZone, err := client.findInstance(params)
-	if err != nil {
-		return err
+	if len(errs) == len(params.Users) {
+		return fmt.Errorf("failed to send the SSH public key for all the users: %s", strings.Join(errs, ", "))
 	}
 
-	err = client.sendPublicKey(params, instanceId, availabilityZone)
-	if err != nil {
-		return err
-	}
+	return nil
+}
 
-	err = client.startSession(params, instanceId)
-	if err != nil {
-		return err
+// sendAcceptedKey sends the key for the user, and the next of --public-key in
+// place of it while it is rejected as invalid, such as an RSA key too short or
+// of an algorithm not supported. The accepted one is then sent for the other
+// users, and used by --local-forward.
+func (c *Client) sendAcceptedKey(ctx context.Context, params *Params, instanceId string, availabilityZone string, user string) error {
+	rejected := false
+	for {
+		err := c.sendPublicKeyFor(ctx, params, instanceId, availabilityZone, user)
+		var aerr awserr.Error
+		if !errors.As(err, &aerr) || aerr.Code() != ec2instanceconnect.ErrCodeInvalidArgsException || len(params.FallbackKeys) == 0 {
+			if err == nil && rejected {
+				logger.Infof("%s is accepted by EC2 Instance Connect", params.PublicKeyPath)
+			}
+			return err
+		}
+		next := params.FallbackKeys[0]
+		logger.Warnf("%s is rejected, trying %s: %v", params.PublicKeyPath, next.Path, err)
+		params.useKeyFile(next)
+		params.FallbackKeys = params.FallbackKeys[1:]
+		rejected = true
 	}
+}
 
-	return nil
+func (c *Client) sendPublicKeyFor(ctx context.Context, params *Params, instanceId string, availabilityZone string, user string) error {
+	in := ec2instanceconnect.SendSSHPublicKeyInput{
+		AvailabilityZone: aws.String(availabilityZone),
+		InstanceId:       aws.String(instanceId),
+		InstanceOSUser:   aws.String(user),
+		SSHPublicKey:     aws.String(params.PublicKey),
+	}
+	return c.call(ctx, func(ctx aws.Context) error {
+		_, err := c.ec2ic.SendSSHPublicKeyWithContext(ctx, &in)
+		return err
+	})
 }
 
-/*
- * Parse arguments
- */
+// SendKeyDeniedError tells that the IAM identity is not allowed to send the
+// SSH public key.
+type SendKeyDeniedError struct {
+	Err error
+}
 
-type Params struct {
-	Profile   string
-	User      string
-	Port      int
-	PublicKey string
-	// ec2 filter
-	Id   string
-	Name string
+func (e *SendKeyDeniedError) Error() string {
+	return fmt.Sprintf("ec2-instance-connect:SendSSHPublicKey is not allowed to the IAM identity "+
+		"(use --no-send-key or --fallback-no-send-key if the key is already authorized on the instance): %v", e.Err)
 }
 
-func parseArgs(args []string) (*Params, error) {
-	ret := Params{}
+func (e *SendKeyDeniedError) Unwrap() error {
+	return e.Err
+}
 
-	var opts struct {
-		Pattern string `long:"pattern" description:"Host name pattern" default:"ec2.{name}"`
-		Profile string `long:"profile" description:"Aws credentials profile name"`
-		KeyFile string `long:"public-key" description:"SSH public key file path" default:"~/.ssh/id_rsa.pub"`
-		User    string `long:"user" description:"OS user on the EC2 instance" default:"ec2-user"`
-		Args    struct {
-			HOST string
-			PORT int
-		} `positional-args:"yes" required:"yes"`
+// isAccessDenied tells whether IAM denied the call.
+func isAccessDenied(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
 	}
-	_, err := flags.NewParser(&opts, flags.HelpFlag|flags.PassDoubleDash).ParseArgs(args)
-	if err != nil {
-		return nil, err
+	switch aerr.Code() {
+	case "AccessDeniedException", "AccessDenied", "UnauthorizedOperation":
+		return true
 	}
+	return false
+}
 
-	ret.Profile = opts.Profile
-	ret.User = opts.User
-	ret.Port = opts.Args.PORT
+func (c *Client) checkPlugin() error {
+	return c.plugin.check()
+}
 
-	// read SSH public key
-	kf := opts.KeyFile
-	if strings.HasPrefix(kf, "~/") {
-		h, err := os.UserHomeDir()
+func (c *Client) startSession(ctx context.Context, params *Params, instanceId string) error {
+	stdio := PluginStdio{In: os.Stdin, Out: os.Stdout, Proxy: true}
+	// in port-forward mode, stdout only tells the plugin is waiting
+	if params.Mode == modePortForward && logger.quiet() {
+		stdio.Out = io.Discard
+	}
+	return c.runSession(ctx, params, instanceId, stdio)
+}
+
+func (c *Client) runSession(ctx context.Context, params *Params, instanceId string, stdio PluginStdio) (err error) {
+	if c.tunnel != nil {
+		c.deadline.stop()
+		// the tunnel has no session ID
+		end := c.trackSession(params, instanceId, "")
+		defer func() { end(err) }()
+		return c.tunnel.run(ctx, c.startedHooks(params, stdio, ""))
+	}
+	in := newStartSessionInput(params, instanceId)
+	if params.CheckDocument {
+		err = c.checkDocument(ctx, in)
 		if err != nil {
-			return nil, err
+			return
 		}
-		kf = filepath.Join(h, kf[2:])
 	}
-	k, err := ioutil.ReadFile(kf)
+	logValue("StartSession input", in)
+	connect := newConnectWatchdog(params.ConnectTimeout)
+	var out *ssm.StartSessionOutput
+	sctx, cancelStart := connect.context(ctx)
+	err = c.call(sctx, func(ctx aws.Context) (err error) {
+		out, err = c.ssm.StartSessionWithContext(ctx, in)
+		return
+	})
+	cancelStart()
+	if err != nil && connect.expired() {
+		return connect.err()
+	}
 	if err != nil {
-		return nil, err
+		c.forgetInstance(params, err)
+		return
+	}
+	c.deadline.stop()
+	logger.Infof("started session %s", aws.StringValue(out.SessionId))
+	started := time.Now()
+	if params.SessionFile != "" {
+		err = newSessionFile(params, c.region, in, out, started).write(params.SessionFile)
+		if err != nil {
+			logger.Warnf("failed to write the session file: %v", err)
+		} else {
+			logger.Infof("wrote the session to %s", params.SessionFile)
+		}
+	}
+	if params.ExpandOnly {
+		return c.expandPlugin(params, in, out)
 	}
-	ret.PublicKey = string(k)
+	end := c.trackSession(params, instanceId, aws.StringValue(out.SessionId))
+	defer func() { end(err) }()
 
-	err = parseHostname(opts.Args.HOST, opts.Pattern, &ret)
+	profile, env, err := c.pluginCredentials(params)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	env = append(env, proxyEnv(params)...)
 
-	return &ret, nil
-}
+	// in port-forward mode, the plugin tells when the port is ready, and
+	// otherwise the first bytes from sshd tell the session is up
+	marker := ""
+	if params.Mode == modePortForward {
+		marker = "Waiting for connections"
+	}
+	pctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stdio.Out = connect.watch(stdio.Out, marker, func() {
+		cancel()
+		_ = c.terminateSession(aws.StringValue(out.SessionId))
+	})
 
-func parseHostname(hostname string, pattern string, p *Params) error {
-	pat := pattern
-	pat = strings.ReplaceAll(pat, "{name}", `(?P<name>[\w-]+)`)
-	pat = strings.ReplaceAll(pat, "{id}", `(?P<id>[\w-]+)`)
-	pat = strings.ReplaceAll(pat, "{profile}", `(?P<profile>[\w-]+)`)
+	stdio = c.startedHooks(params, stdio, aws.StringValue(out.SessionId))
 
-	re, err := regexp.Compile(pat)
+	sig, stop := c.terminateOnSignal(aws.StringValue(out.SessionId))
+	err = c.plugin.start(pctx, profile, c.ssmSigningRegion, c.ssmEndpoint, env, in, out, stdio)
+	stop()
+	connect.stop()
+	if s := <-sig; s != nil {
+		return fmt.Errorf("session terminated by signal: %v", s)
+	}
+	if connect.expired() {
+		return connect.err()
+	}
 	if err != nil {
-		return fmt.Errorf("invalid host name pattern: %s", pattern)
+		return err
 	}
 
-	keys := re.SubexpNames()
-	vals := re.FindStringSubmatch(hostname)
-	for i, k := range keys {
-		v := vals[i]
-		if k == "name" {
-			p.Name = v
-		}
-		if k == "id" {
-			p.Id = v
+	return
+}
+
+// trackSession records the start of the session in the audit log, the
+// events and the metrics, and returns the function recording its end.
+func (c *Client) trackSession(params *Params, instanceId string, sessionId string) func(err error) {
+	started := time.Now()
+	c.metrics.count("session.started")
+	logger.Event("info", "session_started", "instance_id", instanceId, "session_id", sessionId)
+	var entry *AuditEntry
+	if c.audit != nil {
+		entry = &AuditEntry{
+			Event:      "start",
+			Profile:    params.Profile,
+			Region:     c.region,
+			InstanceId: instanceId,
+			Name:       params.ResolvedName,
+			Mode:       params.Mode,
+			Port:       params.Port,
+			SessionId:  sessionId,
 		}
-		if k == "profile" {
-			p.Profile = v
+		if params.Mode == modeSSH {
+			entry.Users = params.Users
 		}
+		c.audit.write(*entry)
 	}
 
-	if p.Name != "" && p.Id != "" {
-		return fmt.Errorf("name and id could not be specified at same time")
-	}
-	if p.Name == "" && p.Id == "" {
-		return fmt.Errorf("neither name nor id is specified")
+	return func(err error) {
+		if entry != nil {
+			entry.Event = "end"
+			d := time.Since(started).Milliseconds()
+			entry.DurationMs = &d
+			if err != nil {
+				entry.Error = err.Error()
+			}
+			c.audit.write(*entry)
+		}
+		kv := []interface{}{"instance_id", instanceId, "session_id", sessionId,
+			"duration_ms", time.Since(started).Milliseconds()}
+		level := "info"
+		if err != nil {
+			level = "error"
+			kv = append(kv, "error", err.Error())
+		}
+		logger.Event(level, "session_ended", kv...)
+		c.metrics.timing("session.duration", time.Since(started))
+		if err != nil {
+			c.metrics.count("session.error")
+		}
 	}
-
-	return nil
 }
 
-/*
- * AWS client
- */
-
-type Client struct {
-	ec2   ec2iface.EC2API
-	ec2ic ec2instanceconnectiface.EC2InstanceConnectAPI
-	ssm   ssmiface.SSMAPI
+// startedHooks makes the stdio print the --output json report and create the
+// --started-file once the session has started.
+func (c *Client) startedHooks(params *Params, stdio PluginStdio, sessionId string) PluginStdio {
+	if c.report != nil {
+		c.report.SessionId = sessionId
+		stdio.Started = func(pid int) {
+			c.report.PluginPid = pid
+			if err := c.report.print(reportWriter(params)); err != nil {
+				logger.Warnf("failed to print the output: %v", err)
+			}
+		}
+	}
 
-	ssmSigningRegion string
-	ssmEndpoint      string
-	plugin SessionManagerPlugin
+	if params.StartedFile != "" {
+		started := stdio.Started
+		stdio.Started = func(pid int) {
+			if started != nil {
+				started(pid)
+			}
+			if err := ioutil.WriteFile(params.StartedFile, nil, 0600); err != nil {
+				logger.Warnf("failed to create %s: %v", params.StartedFile, err)
+			}
+		}
+	}
+	return stdio
 }
 
-func newClient(profile string) *Client {
-	c := Client{}
-
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		Profile:           profile,
-		SharedConfigState: session.SharedConfigEnable,
-	}))
-	c.ec2 = ec2.New(sess)
-	c.ec2ic = ec2instanceconnect.New(sess)
+// terminateOnSignal terminates the session when we are asked to terminate,
+// which the plugin does not know of, so that the session does not linger.
+// The returned channel yields the signal received, if any, once stopped.
+func (c *Client) terminateOnSignal(sessionId string) (<-chan os.Signal, func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM)
+	done := make(chan struct{})
+	ret := make(chan os.Signal, 1)
 
-	s := ssm.New(sess)
-	c.ssm = s
-	c.ssmSigningRegion = s.SigningRegion
-	c.ssmEndpoint = s.Endpoint
+	go func() {
+		var received os.Signal
+		select {
+		case received = <-ch:
+			logger.Infof("received %v, terminating session %s", received, sessionId)
+			err := c.terminateSession(sessionId)
+			if err != nil {
+				logger.Infof("failed to terminate session %s: %v", sessionId, err)
+			}
+		case <-done:
+		}
+		ret <- received
+	}()
 
-	c.plugin = newSessionManagerPlugin()
+	return ret, func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
 
-	return &c
+func (c *Client) terminateSession(sessionId string) error {
+	return c.call(context.Background(), func(ctx aws.Context) error {
+		_, err := c.ssm.TerminateSessionWithContext(ctx, &ssm.TerminateSessionInput{
+			SessionId: aws.String(sessionId),
+		})
+		return err
+	})
 }
 
-func (c *Client) findInstance(params *Params) (instanceId string, availabilityZone string, err error) {
-	in := ec2.DescribeInstancesInput{}
-	if params.Name != "" {
-		in.Filters = []*ec2.Filter{
-			{
-				Name:   aws.String("tag:Name"),
-				Values: []*string{aws.String(params.Name)},
-			},
-		}
+func newStartSessionInput(params *Params, instanceId string) *ssm.StartSessionInput {
+	in := &ssm.StartSessionInput{
+		Target:       aws.String(instanceId),
+		DocumentName: aws.String(params.DocumentName),
+		Parameters: map[string][]*string{
+			"portNumber": {aws.String(strconv.Itoa(params.Port))},
+		},
 	}
-	if params.Id != "" {
-		in.InstanceIds = []*string{
-			aws.String(params.Id),
-		}
+	if params.Mode == modePortForward {
+		in.Parameters["localPortNumber"] = []*string{aws.String(strconv.Itoa(params.LocalPort))}
+	}
+	for k, v := range params.Parameters {
+		in.Parameters[k] = aws.StringSlice(v)
 	}
-	out, err := c.ec2.DescribeInstances(&in)
+	return in
+}
+
+// freeLocalPort returns a local port which is free now, for the plugin to
+// listen on.
+func freeLocalPort() (int, error) {
+	l, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
-		return
+		return 0, fmt.Errorf("failed to find a free local port: %v", err)
 	}
-	if len(out.Reservations) == 0 || len(out.Reservations[0].Instances) == 0 {
-		err = fmt.Errorf("ec2 instance is not found")
-		return
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// pluginCredentials returns the profile and the extra environment variables
+// passed to session-manager-plugin.
+func (c *Client) pluginCredentials(params *Params) (string, []string, error) {
+	v, err := c.credentials.Get()
+	if err != nil {
+		return "", nil, err
 	}
 
-	instanceId = aws.StringValue(out.Reservations[0].Instances[0].InstanceId)
-	availabilityZone = aws.StringValue(out.Reservations[0].Instances[0].Placement.AvailabilityZone)
-	return
+	// The plugin can not assume the role by --assume-role by itself, and
+	// would prompt for the MFA code again to assume the role of the
+	// profile, so hand it over the assumed credentials instead.
+	if params.AssumeRole == "" && v.ProviderName != stscreds.ProviderName {
+		// resolveProfile leaves the profile empty for the credentials in
+		// the environment, and the plugin is given the default one then
+		if params.Profile == "" {
+			return "default", sharedFilesEnv(params), nil
+		}
+		return params.Profile, sharedFilesEnv(params), nil
+	}
+	return "", credentialsEnv(v), nil
 }
 
-func (c *Client) sendPublicKey(params *Params, instanceId string, availabilityZone string) error {
-	in := ec2instanceconnect.SendSSHPublicKeyInput{
-		AvailabilityZone: aws.String(availabilityZone),
-		InstanceId:       aws.String(instanceId),
-		InstanceOSUser:   aws.String(params.User),
-		SSHPublicKey:     aws.String(params.PublicKey),
+// expandPlugin prints the plugin command of the started session to stdout,
+// for the caller to run it by itself.
+func (c *Client) expandPlugin(params *Params, in *ssm.StartSessionInput, out *ssm.StartSessionOutput) error {
+	profile, env, err := c.pluginCredentials(params)
+	if err != nil {
+		return err
 	}
-	_, err := c.ec2ic.SendSSHPublicKey(&in)
+	env = append(env, proxyEnv(params)...)
+	args, err := c.plugin.args(profile, c.ssmSigningRegion, c.ssmEndpoint, in, out)
 	if err != nil {
 		return err
 	}
-
-	return nil
-}
-
-func (c *Client) checkPlugin() error {
-	return c.plugin.check()
+	logger.Infof("session %s is left to the caller", aws.StringValue(out.SessionId))
+	return (&ExpandedCommand{SessionId: aws.StringValue(out.SessionId), Argv: args, Env: env}).print(os.Stdout)
 }
 
-func (c *Client) startSession(params *Params, instanceId string) (err error) {
-	in := &ssm.StartSessionInput{
-		Target:       aws.String(instanceId),
-		DocumentName: aws.String("AWS-StartSSHSession"),
-		Parameters: map[string][]*string{
-			"portNumber": {aws.String(strconv.Itoa(params.Port))},
-		},
-	}
-	out, err := c.ssm.StartSession(in)
+func (c *Client) dryRun(params *Params, instanceId string, availabilityZone string) error {
+	in := newStartSessionInput(params, instanceId)
+	i, err := json.Marshal(in)
 	if err != nil {
-		return
+		return err
 	}
-
-	err = c.plugin.start(params, c.ssmSigningRegion, c.ssmEndpoint, in, out)
+	profile, _, err := c.pluginCredentials(params)
 	if err != nil {
 		return err
 	}
+	command := "none (--native)"
+	var args []string
+	if !params.Native {
+		args, err = c.plugin.args(profile, c.ssmSigningRegion, c.ssmEndpoint, in, &ssm.StartSessionOutput{})
+		if err != nil {
+			return err
+		}
+		args[1] = "<StartSession response>"
+		command = shellJoin(args)
+	}
+	if c.report != nil {
+		if c.tunnel == nil {
+			c.report.StartSession = in
+			c.report.PluginCommand = args
+		}
+		return c.report.print(os.Stdout)
+	}
 
-	return
+	w := os.Stderr
+	_, _ = fmt.Fprintf(w, "instance id:       %s\n", instanceId)
+	_, _ = fmt.Fprintf(w, "availability zone: %s\n", availabilityZone)
+	if params.Mode == modeSSH {
+		_, _ = fmt.Fprintf(w, "os user:           %s\n", strings.Join(params.Users, ", "))
+	}
+	if params.Mode == modeSSH && params.NoSendKey {
+		_, _ = fmt.Fprintf(w, "send key:          skipped (--no-send-key)\n")
+	}
+	if c.tunnel != nil {
+		_, _ = fmt.Fprintf(w, "eice endpoint:     %s (%s)\n", c.tunnel.endpointId, c.tunnel.dnsName)
+		_, _ = fmt.Fprintf(w, "tunnel to:         %s\n", net.JoinHostPort(c.tunnel.privateIp, strconv.Itoa(c.tunnel.port)))
+		return nil
+	}
+	_, _ = fmt.Fprintf(w, "start session:     %s\n", i)
+	_, _ = fmt.Fprintf(w, "plugin command:    %s\n", command)
+	return nil
+}
+
+func shellJoin(args []string) string {
+	q := make([]string, len(args))
+	for n, a := range args {
+		if a != "" && !strings.ContainsAny(a, " \t\n\"'\\$`{}[]*?<>|&;()#~!") {
+			q[n] = a
+		} else {
+			q[n] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(q, " ")
 }
 
 /*
@@ -267,67 +2177,261 @@ func (c *Client) startSession(params *Params, instanceId string) (err error) {
 
 type SessionManagerPlugin interface {
 	check() error
-	start(params *Params, region string, endpoint string, ssmInput *ssm.StartSessionInput, ssmOutput *ssm.StartSessionOutput) error
+	args(profile string, region string, endpoint string, ssmInput *ssm.StartSessionInput, ssmOutput *ssm.StartSessionOutput) ([]string, error)
+	start(ctx context.Context, profile string, region string, endpoint string, env []string, ssmInput *ssm.StartSessionInput, ssmOutput *ssm.StartSessionOutput, stdio PluginStdio) error
+}
+
+// PluginStdio is the standard input and output of session-manager-plugin.
+type PluginStdio struct {
+	In  io.Reader
+	Out io.Writer
+	// whether the plugin is our ProxyCommand's stdio, in which case the
+	// signals from the terminal are meant for ssh and ignored
+	Proxy bool
+	// called with the pid of the plugin once it has started
+	Started func(pid int)
 }
 
-type SessionManagerPluginImpl struct {}
+type SessionManagerPluginImpl struct {
+	path             string
+	minVersion       string
+	skipVersionCheck bool
+}
 
-func newSessionManagerPlugin() SessionManagerPlugin {
-	return &SessionManagerPluginImpl{}
+func newSessionManagerPlugin(params *Params) SessionManagerPlugin {
+	return &SessionManagerPluginImpl{
+		path:             params.PluginPath,
+		minVersion:       params.MinPluginVersion,
+		skipVersionCheck: params.SkipPluginVersionCheck,
+	}
 }
 
-func (*SessionManagerPluginImpl) check() error {
-	_, err := exec.LookPath("session-manager-plugin")
+func (c *SessionManagerPluginImpl) check() error {
+	if c.path != "" {
+		fi, err := os.Stat(c.path)
+		if err != nil {
+			return fmt.Errorf("session-manager-plugin is not found: %v", err)
+		}
+		if fi.IsDir() || (runtime.GOOS != "windows" && fi.Mode()&0111 == 0) {
+			return fmt.Errorf("session-manager-plugin is not executable: %s", c.path)
+		}
+	} else {
+		p, err := exec.LookPath("session-manager-plugin")
+		if err != nil {
+			return fmt.Errorf("SessionManagerPlugin is not found. \n" +
+				"Please refer to SessionManager Documentation here: \n" +
+				"http://docs.aws.amazon.com/console/systems-manager/\n" +
+				"session-manager-plugin-not-found")
+		}
+		c.path = p
+	}
+
+	if c.skipVersionCheck {
+		return nil
+	}
+
+	v, err := c.version()
 	if err != nil {
-		return fmt.Errorf("SessionManagerPlugin is not found. \n" +
-			"Please refer to SessionManager Documentation here: \n" +
-			"http://docs.aws.amazon.com/console/systems-manager/\n" +
-			"session-manager-plugin-not-found")
+		return err
+	}
+	if compareVersions(v, c.minVersion) < 0 {
+		return fmt.Errorf("session-manager-plugin %s is too old, %s or later is required.\n"+
+			"Please upgrade it (or pass --skip-plugin-version-check):\n"+
+			"https://docs.aws.amazon.com/systems-manager/latest/userguide/session-manager-working-with-install-plugin.html",
+			v, c.minVersion)
 	}
 	return nil
 }
 
-func (c *SessionManagerPluginImpl) start(params *Params, region string, endpoint string, in *ssm.StartSessionInput, out *ssm.StartSessionOutput) error {
+func (c *SessionManagerPluginImpl) version() (string, error) {
+	out, err := exec.Command(c.path, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get the session-manager-plugin version: %v", err)
+	}
+	v := strings.TrimSpace(string(out))
+	if !versionPattern.MatchString(v) {
+		return "", fmt.Errorf("unexpected session-manager-plugin version: %s", v)
+	}
+	return v, nil
+}
+
+var versionPattern = regexp.MustCompile(`^\d+(\.\d+)*$`)
+
+// compareVersions compares dot-separated numeric versions like 1.2.30.0.
+func compareVersions(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func (c *SessionManagerPluginImpl) args(profile string, region string, endpoint string, in *ssm.StartSessionInput, out *ssm.StartSessionOutput) ([]string, error) {
 	i, err := json.Marshal(in)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	o, err := json.Marshal(out)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	cmd := exec.Command(
-		"session-manager-plugin",
+	return []string{
+		c.path,
 		string(o),
 		region,
 		"StartSession",
-		params.Profile,
+		profile,
 		string(i),
 		endpoint,
-	)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	}, nil
+}
 
-	c.ignoreUserSignals(func() {
-		err = cmd.Run()
-	})
+// start runs the plugin until it exits, or is killed when ctx is done.
+func (c *SessionManagerPluginImpl) start(ctx context.Context, profile string, region string, endpoint string, env []string, in *ssm.StartSessionInput, out *ssm.StartSessionOutput, stdio PluginStdio) error {
+	args, err := c.args(profile, region, endpoint, in, out)
+	if err != nil {
+		return err
+	}
+
+	logger.Debugf("running %s", args[0])
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	// stop copying the stdio soon after the plugin exits or is killed, even
+	// if its children still hold it
+	cmd.WaitDelay = time.Second
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	// keep the end of stderr for the error, as it may not be visible when
+	// run as ProxyCommand
+	stderr := &tailBuffer{}
+	cmd.Stdin = stdio.In
+	cmd.Stdout = stdio.Out
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	if logger.quiet() {
+		cmd.Stderr = stderr
+	}
+
+	if stdio.Proxy {
+		ignoreUserSignals(func() {
+			err = runForwardingSignals(cmd, stdio.Started)
+		})
+	} else {
+		err = runForwardingSignals(cmd, stdio.Started)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return &PluginExitError{Code: exitErr.ExitCode(), Stderr: stderr.lines(pluginStderrLines)}
+	}
 	if err != nil {
+		if out := stderr.lines(pluginStderrLines); out != "" {
+			return fmt.Errorf("session-manager-plugin failed: %v:\n%s", err, out)
+		}
 		return err
 	}
 
 	return nil
 }
 
-func (*SessionManagerPluginImpl) ignoreUserSignals(f func()) {
-	var sig []os.Signal
-	if runtime.GOOS == "windows" {
-		sig = []os.Signal{syscall.SIGINT}
-	} else {
-		sig = []os.Signal{syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTSTP}
+// PluginExitError is returned when session-manager-plugin exits with a
+// non-zero status, which is then used as our own exit status.
+type PluginExitError struct {
+	Code   int
+	Stderr string
+}
+
+func (e *PluginExitError) Error() string {
+	msg := fmt.Sprintf("session-manager-plugin exited with status %d", e.Code)
+	if e.Stderr != "" {
+		msg += ":\n" + e.Stderr
+	}
+	return msg
+}
+
+const pluginStderrLines = 5
+
+// tailBuffer keeps the last bytes written to it.
+type tailBuffer struct {
+	buf []byte
+}
+
+const tailBufferSize = 4096
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > tailBufferSize {
+		b.buf = b.buf[len(b.buf)-tailBufferSize:]
+	}
+	return len(p), nil
+}
+
+// lines returns the last n non-empty lines.
+func (b *tailBuffer) lines(n int) string {
+	var ret []string
+	for _, l := range strings.Split(string(b.buf), "\n") {
+		l = strings.TrimRight(l, "\r")
+		if strings.TrimSpace(l) != "" {
+			ret = append(ret, l)
+		}
+	}
+	if len(ret) > n {
+		ret = ret[len(ret)-n:]
+	}
+	return strings.Join(ret, "\n")
+}
+
+// runForwardingSignals runs cmd, relaying the forwarded signals to it.
+// started, if not nil, is called once it has started.
+func runForwardingSignals(cmd *exec.Cmd, started func(pid int)) error {
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	if started != nil {
+		started(cmd.Process.Pid)
 	}
 
+	sig := forwardedSignals()
+	if len(sig) > 0 {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, sig...)
+		done := make(chan struct{})
+		defer func() {
+			signal.Stop(ch)
+			close(done)
+		}()
+		go func() {
+			for {
+				select {
+				case s := <-ch:
+					_ = cmd.Process.Signal(s)
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	return cmd.Wait()
+}
+
+// ignoreUserSignals runs f ignoring the signals from the terminal, which are
+// meant for ssh.
+func ignoreUserSignals(f func()) {
+	sig := ignoredSignals()
 	signal.Ignore(sig...)
 	defer signal.Reset(sig...)
 
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeEC2 returns the instances of each page of DescribeInstances, and
+// records the inputs.
+type fakeEC2 struct {
+	ec2iface.EC2API
+	pages  [][]*ec2.Instance
+	inputs []*ec2.DescribeInstancesInput
+}
+
+func (f *fakeEC2) DescribeInstancesPagesWithContext(ctx aws.Context, in *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool, opts ...request.Option) error {
+	f.inputs = append(f.inputs, in)
+	for n, instances := range f.pages {
+		out := &ec2.DescribeInstancesOutput{}
+		if len(instances) > 0 {
+			out.Reservations = []*ec2.Reservation{{Instances: instances}}
+		}
+		if n < len(f.pages)-1 {
+			out.NextToken = aws.String("page")
+		}
+		if !fn(out, n == len(f.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func newFakeClient(pages ...[]*ec2.Instance) (*Client, *fakeEC2) {
+	f := &fakeEC2{pages: pages}
+	return &Client{ec2: f, timeout: time.Minute, region: "us-east-1"}, f
+}
+
+func TestProfilePrecedence(t *testing.T) {
+	tests := []struct {
+		name     string
+		flag     string
+		host     string
+		config   string
+		env      string
+		want     string
+		fromFlag bool
+		fromHost bool
+	}{
+		{"default", "", "ec2.web", "", "", "default", false, false},
+		{"env", "", "ec2.web", "", "envp", "envp", false, false},
+		{"config", "", "ec2.web", "confp", "", "confp", false, false},
+		{"config over env", "", "ec2.web", "confp", "envp", "confp", false, false},
+		{"host name", "", "web.hostp.aws", "", "", "hostp", false, true},
+		{"host name over env", "", "web.hostp.aws", "", "envp", "hostp", false, true},
+		{"host name over config", "", "web.hostp.aws", "confp", "", "hostp", false, true},
+		{"host name over config and env", "", "web.hostp.aws", "confp", "envp", "hostp", false, true},
+		{"flag", "flagp", "ec2.web", "", "", "flagp", true, false},
+		{"flag over env", "flagp", "ec2.web", "", "envp", "flagp", true, false},
+		{"flag over config", "flagp", "ec2.web", "confp", "", "flagp", true, false},
+		{"flag over host name", "flagp", "web.hostp.aws", "", "", "flagp", true, false},
+		{"flag over all", "flagp", "web.hostp.aws", "confp", "envp", "flagp", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setSharedConfig(t, "")
+			content := "pattern:\n  - \"{name}.{profile}.aws\"\n  - \"ec2.{name}\"\n"
+			if tt.config != "" {
+				content += "profile: " + tt.config + "\n"
+			}
+			if tt.env != "" {
+				t.Setenv("AWS_PROFILE", tt.env)
+			}
+			args := []string{"--config", writeConfig(t, content), "--no-send-key"}
+			if tt.flag != "" {
+				args = append(args, "--profile", tt.flag)
+			}
+			params, err := parseArgs(append(args, tt.host, "22"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if params.Profile != tt.want || params.ProfileFlag != tt.fromFlag || params.ProfileFromHost != tt.fromHost {
+				t.Errorf("Profile = %q (flag %v, host %v), want %q (flag %v, host %v)",
+					params.Profile, params.ProfileFlag, params.ProfileFromHost, tt.want, tt.fromFlag, tt.fromHost)
+			}
+		})
+	}
+}
+
+func TestParseHostnameProfileFlag(t *testing.T) {
+	patterns := []string{"{name}.{profile}.aws", "{name}.{account}.acct", "{name}.{env}.env"}
+	mapped := Params{AccountProfiles: map[string]string{"123456789012": "acctp"}, EnvProfiles: map[string]string{"stg": "envp"}}
+	tests := []struct {
+		name     string
+		host     string
+		flag     bool
+		want     string
+		fromHost bool
+	}{
+		{"profile", "web.hostp.aws", false, "hostp", true},
+		{"account", "web.123456789012.acct", false, "acctp", true},
+		{"env", "web.stg.env", false, "envp", true},
+		{"flag over profile", "web.hostp.aws", true, "flagp", false},
+		{"flag over account", "web.123456789012.acct", true, "flagp", false},
+		{"flag over env", "web.stg.env", true, "flagp", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := mapped
+			if tt.flag {
+				p.Profile = "flagp"
+				p.ProfileFlag = true
+			}
+			err := parseHostname(tt.host, patterns, true, &p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Profile != tt.want || p.ProfileFromHost != tt.fromHost {
+				t.Errorf("Profile = %q (host %v), want %q (host %v)", p.Profile, p.ProfileFromHost, tt.want, tt.fromHost)
+			}
+		})
+	}
+}
+
+func TestProfileFromEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  string
+		want string
+		flag bool
+	}{
+		{"over host name", []string{"--profile-from-env", "web.hostp.aws"}, "envp", "envp", true},
+		{"over config", []string{"--profile-from-env", "ec2.web"}, "envp", "envp", true},
+		{"unset", []string{"--profile-from-env", "web.hostp.aws"}, "", "hostp", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setSharedConfig(t, "")
+			if tt.env != "" {
+				t.Setenv("AWS_PROFILE", tt.env)
+			}
+			content := "pattern:\n  - \"{name}.{profile}.aws\"\n  - \"ec2.{name}\"\nprofile: confp\n"
+			args := []string{"--config", writeConfig(t, content), "--no-send-key"}
+			params, err := parseArgs(append(append(args, tt.args...), "22"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if params.Profile != tt.want || params.ProfileFlag != tt.flag {
+				t.Errorf("Profile = %q (flag %v), want %q (flag %v)", params.Profile, params.ProfileFlag, tt.want, tt.flag)
+			}
+		})
+	}
+
+	setSharedConfig(t, "")
+	_, err := parseArgs([]string{"--config", writeConfig(t, ""), "--profile-from-env", "--profile", "prod", "ec2.web", "22"})
+	if err == nil {
+		t.Errorf("--profile-from-env with --profile is not an error")
+	}
+}
+
+func TestFindInstanceWithoutPlacement(t *testing.T) {
+	c, _ := newFakeClient([]*ec2.Instance{{InstanceId: aws.String("i-0123456789abcdef0"), PrivateIpAddress: aws.String("10.0.0.1")}})
+	params := &Params{Names: []string{"web"}, Users: []string{"ec2-user"}}
+	i, err := c.findInstance(context.Background(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if az := instanceAZ(i); az != "" {
+		t.Errorf("instanceAZ() = %q, want empty", az)
+	}
+	// fails before calling EC2 Instance Connect, which is nil here
+	err = c.sendPublicKey(context.Background(), params, aws.StringValue(i.InstanceId), instanceAZ(i))
+	if err == nil || !strings.Contains(err.Error(), "availability zone") {
+		t.Errorf("sendPublicKey() = %v, want the error of the unknown availability zone", err)
+	}
+}
+
+func TestFindInstanceWithoutInstanceId(t *testing.T) {
+	c, _ := newFakeClient([]*ec2.Instance{{PrivateIpAddress: aws.String("10.0.0.1")}})
+	_, err := c.findInstance(context.Background(), &Params{Names: []string{"web"}})
+	if err == nil || !strings.Contains(err.Error(), "instance ID") {
+		t.Errorf("findInstance() = %v, want the error of the missing instance ID", err)
+	}
+}
+
+func TestNameTagKeyFilter(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"--name", []string{"--name", "web", "ec2.other"}, "web"},
+		{"pattern", []string{"ec2.web"}, "web"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setSharedConfig(t, "")
+			args := append([]string{"--config", writeConfig(t, ""), "--no-send-key", "--no-cache", "--name-tag-key", "hostname"}, tt.args...)
+			params, err := parseArgs(append(args, "22"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, f := newFakeClient([]*ec2.Instance{{InstanceId: aws.String("i-0123456789abcdef0")}})
+			_, err = c.findInstance(context.Background(), params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, filter := range f.inputs[0].Filters {
+				if aws.StringValue(filter.Name) == "tag:Name" {
+					t.Errorf("filtered by tag:Name")
+				}
+				if aws.StringValue(filter.Name) == "tag:hostname" {
+					got = aws.StringValueSlice(filter.Values)
+				}
+			}
+			if len(got) != 1 || got[0] != tt.want {
+				t.Errorf("tag:hostname filter = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindInstancePagination(t *testing.T) {
+	id := "i-0123456789abcdef0"
+	c, _ := newFakeClient(nil, []*ec2.Instance{{InstanceId: aws.String(id)}})
+	i, err := c.findInstance(context.Background(), &Params{Names: []string{"web"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(i.InstanceId) != id {
+		t.Errorf("findInstance() = %s, want %s", aws.StringValue(i.InstanceId), id)
+	}
+
+	// the instances of all the pages are chosen from
+	launched := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c, _ = newFakeClient(
+		[]*ec2.Instance{{InstanceId: aws.String("i-0000000000000000a"), LaunchTime: aws.Time(launched)}},
+		[]*ec2.Instance{{InstanceId: aws.String(id), LaunchTime: aws.Time(launched.Add(time.Hour))}},
+	)
+	i, err = c.findInstance(context.Background(), &Params{Names: []string{"web"}, PickFirst: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(i.InstanceId) != id {
+		t.Errorf("findInstance() = %s, want the newest %s", aws.StringValue(i.InstanceId), id)
+	}
+}
+
+func TestFindInstanceByTags(t *testing.T) {
+	setSharedConfig(t, "")
+	params, err := parseArgs([]string{"--config", writeConfig(t, ""), "--no-send-key", "--no-cache",
+		"--tag", "Service=api", "--tag", "Env=prod", "ec2.dummy", "22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, f := newFakeClient([]*ec2.Instance{{InstanceId: aws.String("i-0123456789abcdef0")}})
+	_, err = c.findInstance(context.Background(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, filter := range f.inputs[0].Filters {
+		got[aws.StringValue(filter.Name)] = strings.Join(aws.StringValueSlice(filter.Values), ",")
+	}
+	if _, ok := got["tag:Name"]; ok {
+		t.Errorf("filtered by the Name tag of the host name: %v", got)
+	}
+	if got["tag:Service"] != "api" || got["tag:Env"] != "prod" {
+		t.Errorf("filters = %v, want tag:Service=api and tag:Env=prod", got)
+	}
+}
+
+func TestValidateSessionTags(t *testing.T) {
+	many := make([]Tag, maxSessionTags+1)
+	for i := range many {
+		many[i] = Tag{Key: fmt.Sprintf("k%d", i), Value: "v"}
+	}
+	tests := []struct {
+		name           string
+		tags           []Tag
+		sourceIdentity string
+		ok             bool
+	}{
+		{"none", nil, "", true},
+		{"tag", []Tag{{"Project", "web:api/v1 +=@-_."}}, "", true},
+		{"maximum tags", many[:maxSessionTags], "", true},
+		{"too many tags", many, "", false},
+		{"longest key", []Tag{{strings.Repeat("k", maxSessionTagKeyLength), "v"}}, "", true},
+		{"too long key", []Tag{{strings.Repeat("k", maxSessionTagKeyLength+1), "v"}}, "", false},
+		{"longest value", []Tag{{"k", strings.Repeat("v", maxSessionTagValueLength)}}, "", true},
+		{"too long value", []Tag{{"k", strings.Repeat("v", maxSessionTagValueLength+1)}}, "", false},
+		{"invalid key", []Tag{{"k;", "v"}}, "", false},
+		{"invalid value", []Tag{{"k", "v*"}}, "", false},
+		{"duplicate keys", []Tag{{"Project", "a"}, {"project", "b"}}, "", false},
+		{"source identity", nil, "alice@example.com", true},
+		{"too short source identity", nil, "a", false},
+		{"too long source identity", nil, strings.Repeat("a", maxSourceIdentityLength+1), false},
+		{"invalid source identity", nil, "alice smith", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSessionTags(tt.tags, tt.sourceIdentity)
+			if (err == nil) != tt.ok {
+				t.Errorf("validateSessionTags() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseHostnameUnmappedAccount(t *testing.T) {
+	setSharedConfig(t, "[default]\nregion = us-east-1\n[profile prod]\nregion = us-east-1\n[sso-session corp]\nsso_region = us-east-1\n")
+	p := Params{AccountProfiles: map[string]string{"111111111111": "dev"}}
+	err := parseHostname("web.123456789012.acct", []string{"{name}.{account}.acct"}, true, &p)
+	if err == nil {
+		t.Fatal("an unmapped account is not an error")
+	}
+	for _, s := range []string{"111111111111=dev", "--account-profile 123456789012=PROFILE", "profiles: default, prod"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("error %q does not contain %q", err, s)
+		}
+	}
+	if strings.Contains(err.Error(), "corp") {
+		t.Errorf("error %q lists the SSO session", err)
+	}
+}
+
+func TestCheckKeyPerms(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		args   []string
+		want   bool
+	}{
+		{"default", "", nil, true},
+		{"flag", "", []string{"--check-key-perms"}, true},
+		{"false", "", []string{"--check-key-perms=false"}, false},
+		{"--no-check-key-perms", "", []string{"--no-check-key-perms"}, false},
+		{"config", "check-key-perms: false\n", nil, false},
+		{"flag over config", "check-key-perms: false\n", []string{"--check-key-perms"}, true},
+		{"port-forward mode", "", []string{"--mode", "port-forward"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setSharedConfig(t, "")
+			args := append([]string{"--config", writeConfig(t, tt.config), "--no-send-key"}, tt.args...)
+			params, err := parseArgs(append(args, "ec2.web", "22"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if params.CheckKeyPerms != tt.want {
+				t.Errorf("CheckKeyPerms = %v, want %v", params.CheckKeyPerms, tt.want)
+			}
+		})
+	}
+
+	// the optional value is passed on joined to the option
+	args := optionArgs(&keyOptions{Perms: "false"})
+	if !containsString(args, "--check-key-perms=false") {
+		t.Errorf("optionArgs() = %q, want --check-key-perms=false", args)
+	}
+}
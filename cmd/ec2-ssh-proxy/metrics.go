@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/*
+ * Metrics
+ */
+
+const (
+	metricsPrefix = "ec2_ssh_proxy."
+	// a datagram is dropped rather than delaying the connection
+	metricsWriteTimeout = 100 * time.Millisecond
+)
+
+// Metrics sends the timings of the AWS API calls and the sessions to statsd.
+// Each metric is a UDP datagram sent right away, so that nothing is left to
+// flush on exit, and a failure is only logged.
+type Metrics struct {
+	conn net.Conn
+}
+
+// newMetrics returns nil when no endpoint is given.
+func newMetrics(params *Params) *Metrics {
+	if params.MetricsEndpoint == "" {
+		return nil
+	}
+	addr, err := metricsAddress(params.MetricsEndpoint)
+	if err == nil {
+		var conn net.Conn
+		conn, err = net.Dial("udp", addr)
+		if err == nil {
+			return &Metrics{conn: conn}
+		}
+	}
+	logger.Warnf("metrics are disabled: %v", err)
+	return nil
+}
+
+// metricsAddress takes host:port, or statsd:// or udp:// followed by it.
+func metricsAddress(endpoint string) (string, error) {
+	addr := endpoint
+	if strings.Contains(endpoint, "://") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return "", err
+		}
+		if u.Scheme != "statsd" && u.Scheme != "udp" {
+			return "", fmt.Errorf("unsupported metrics endpoint %s, only statsd over UDP is supported", endpoint)
+		}
+		addr = u.Host
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", fmt.Errorf("invalid metrics endpoint %s: %v", endpoint, err)
+	}
+	return addr, nil
+}
+
+// request records the time taken by a completed AWS API call, including the
+// retries, and counts the failures.
+func (m *Metrics) request(r *request.Request) {
+	name := "api." + snakeCase(r.Operation.Name)
+	m.timing(name, time.Since(r.Time))
+	if r.Error != nil {
+		m.count(name + ".error")
+	}
+}
+
+func (m *Metrics) timing(name string, d time.Duration) {
+	m.send(fmt.Sprintf("%s%s:%d|ms", metricsPrefix, name, d.Milliseconds()))
+}
+
+func (m *Metrics) count(name string) {
+	m.send(fmt.Sprintf("%s%s:1|c", metricsPrefix, name))
+}
+
+func (m *Metrics) send(s string) {
+	if m == nil {
+		return
+	}
+	_ = m.conn.SetWriteDeadline(time.Now().Add(metricsWriteTimeout))
+	_, err := m.conn.Write([]byte(s))
+	if err != nil {
+		logger.Debugf("failed to send the metric %s: %v", s, err)
+	}
+}
+
+// snakeCase turns an operation name like SendSSHPublicKey into
+// send_ssh_public_key.
+func snakeCase(s string) string {
+	rs := []rune(s)
+	var b strings.Builder
+	for i, r := range rs {
+		if unicode.IsUpper(r) && i > 0 {
+			// the start of a word, or of the last word after an acronym
+			if unicode.IsLower(rs[i-1]) || (i+1 < len(rs) && unicode.IsLower(rs[i+1])) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
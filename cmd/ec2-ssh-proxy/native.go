@@ -0,0 +1,670 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"golang.org/x/net/websocket"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Native data channel (experimental)
+ */
+
+// nativePlugin speaks the SSM data channel protocol by itself, in place of
+// session-manager-plugin. Only a plain port session bridged to the stdio is
+// supported, which is what AWS-StartSSHSession is: KMS encryption,
+// multiplexed port forwarding and resuming a dropped connection are not.
+// The input is sent again until the agent acknowledges it, but the session
+// fails when it is never acknowledged.
+type nativePlugin struct {
+	// the interval of the pings, nativePingInterval if zero
+	keepalive time.Duration
+	// the largest input payload, nativeChunkSize if zero
+	bufferSize int
+}
+
+// the client version told to the agent, which enables the same features as
+// the plugin of this version
+const nativeClientVersion = "1.2.0.0"
+
+// the first agent version accepting the TerminateSession flag
+const terminateFlagAgentVersion = "2.3.722.0"
+
+const (
+	msgInputStreamData  = "input_stream_data"
+	msgOutputStreamData = "output_stream_data"
+	msgAcknowledge      = "acknowledge"
+	msgChannelClosed    = "channel_closed"
+)
+
+const (
+	payloadOutput            = 1
+	payloadError             = 2
+	payloadHandshakeRequest  = 5
+	payloadHandshakeResponse = 6
+	payloadHandshakeComplete = 7
+	payloadFlag              = 10
+	payloadStdErr            = 11
+)
+
+const (
+	flagTerminateSession   = 2
+	flagConnectToPortError = 3
+)
+
+const (
+	actionStatusSuccess     = 1
+	actionStatusUnsupported = 3
+)
+
+const (
+	nativeChunkSize    = 1024
+	nativePingInterval = 5 * time.Minute
+
+	nativeHandshakeTimeout = 30 * time.Second
+	// an input message is sent again when not acknowledged within the
+	// timeout, up to the attempts (about 5 minutes), as the plugin does
+	nativeResendTimeout  = time.Second
+	nativeResendAttempts = 300
+	// the input is not read while this many messages are not acknowledged
+	nativeMaxUnacknowledged = 1000
+)
+
+func (nativePlugin) check() error {
+	return nil
+}
+
+func (nativePlugin) args(profile string, region string, endpoint string, in *ssm.StartSessionInput, out *ssm.StartSessionOutput) ([]string, error) {
+	return nil, fmt.Errorf("no plugin command with --native")
+}
+
+// start bridges the stdio to the data channel until either side closes it,
+// or ctx is done.
+func (p nativePlugin) start(ctx context.Context, profile string, region string, endpoint string, env []string, in *ssm.StartSessionInput, out *ssm.StartSessionOutput, stdio PluginStdio) (err error) {
+	if stdio.Proxy {
+		ignoreUserSignals(func() {
+			err = p.run(ctx, out, stdio)
+		})
+		return
+	}
+	return p.run(ctx, out, stdio)
+}
+
+func (p nativePlugin) run(ctx context.Context, out *ssm.StartSessionOutput, stdio PluginStdio) error {
+	logger.Debugf("opening the data channel %s", aws.StringValue(out.StreamUrl))
+	config, err := websocket.NewConfig(aws.StringValue(out.StreamUrl), "http://localhost")
+	if err != nil {
+		return fmt.Errorf("invalid stream URL: %v", err)
+	}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to open the data channel: %v", err)
+	}
+	ch := &dataChannel{ws: ws, out: stdio.Out, done: make(chan struct{})}
+	defer ch.close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ch.close()
+		case <-done:
+		}
+	}()
+
+	err = ch.open(aws.StringValue(out.TokenValue))
+	if err != nil {
+		return err
+	}
+	if stdio.Started != nil {
+		// there is no plugin process
+		stdio.Started(0)
+	}
+	interval := p.keepalive
+	if interval <= 0 {
+		interval = nativePingInterval
+	}
+	go ch.ping(interval)
+	go ch.resend()
+	size := p.bufferSize
+	if size <= 0 {
+		size = nativeChunkSize
+	}
+	go ch.copyInput(stdio.In, size)
+
+	err = ch.receive()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if ferr := ch.failure(); ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// dataChannel is an open data channel of a session.
+type dataChannel struct {
+	ws  *websocket.Conn
+	out io.Writer
+
+	mu       sync.Mutex
+	sequence int64
+	closed   bool
+	// closed with the channel
+	done chan struct{}
+	// why the channel is closed by ourselves, if failed
+	err error
+
+	// the input messages not acknowledged yet by their sequence numbers,
+	// which are sent again, and signaled when one is acknowledged
+	unacknowledged map[int64]*pendingInput
+	acknowledged   *sync.Cond
+
+	// the agent messages are processed in the order of their sequence
+	// numbers, holding the ones arriving early
+	expected     int64
+	early        map[int64]*agentMessage
+	agentVersion string
+	handshaken   chan struct{}
+	// the agent may send HandshakeComplete again
+	handshakeOnce sync.Once
+}
+
+func (c *dataChannel) open(token string) error {
+	c.early = map[int64]*agentMessage{}
+	c.handshaken = make(chan struct{})
+	c.unacknowledged = map[int64]*pendingInput{}
+	c.acknowledged = sync.NewCond(&c.mu)
+	b, err := json.Marshal(map[string]string{
+		"MessageSchemaVersion": "1.0",
+		"RequestId":            newUuid(),
+		"TokenValue":           token,
+		"ClientId":             newUuid(),
+		"ClientVersion":        nativeClientVersion,
+	})
+	if err != nil {
+		return err
+	}
+	err = websocket.Message.Send(c.ws, string(b))
+	if err != nil {
+		return fmt.Errorf("failed to open the data channel: %v", err)
+	}
+	return nil
+}
+
+func (c *dataChannel) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+		_ = c.ws.Close()
+		if c.acknowledged != nil {
+			c.acknowledged.Broadcast()
+		}
+	}
+}
+
+// fail closes the channel for the error, which the session ends with.
+func (c *dataChannel) fail(err error) {
+	c.mu.Lock()
+	if !c.closed && c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	c.close()
+}
+
+func (c *dataChannel) failure() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// pendingInput is an input message waiting for its acknowledge.
+type pendingInput struct {
+	data     []byte
+	sent     time.Time
+	attempts int
+}
+
+// send sends a message, numbering the input stream data, which is kept
+// until acknowledged.
+func (c *dataChannel) send(m *agentMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return io.ErrClosedPipe
+	}
+	if m.Type != msgInputStreamData {
+		return websocket.Message.Send(c.ws, m.marshal())
+	}
+	m.Sequence = c.sequence
+	c.sequence++
+	b := m.marshal()
+	c.unacknowledged[m.Sequence] = &pendingInput{data: b, sent: time.Now(), attempts: 1}
+	return websocket.Message.Send(c.ws, b)
+}
+
+// waitAcknowledged blocks while too many input messages are not
+// acknowledged, so that a stalled agent does not pile up the input.
+func (c *dataChannel) waitAcknowledged() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.unacknowledged) >= nativeMaxUnacknowledged && !c.closed {
+		c.acknowledged.Wait()
+	}
+}
+
+func (c *dataChannel) receiveAcknowledge(m *agentMessage) {
+	var p struct {
+		AcknowledgedMessageSequenceNumber int64
+	}
+	err := json.Unmarshal(m.Payload, &p)
+	if err != nil {
+		logger.Debugf("invalid acknowledge: %v", err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.unacknowledged, p.AcknowledgedMessageSequenceNumber)
+	c.acknowledged.Broadcast()
+}
+
+// resend sends the input messages not acknowledged in time again, in the
+// order of their sequence numbers. The channel fails when one is never
+// acknowledged, as the agent would otherwise wait for it forever.
+func (c *dataChannel) resend() {
+	t := time.NewTicker(nativeResendTimeout / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+		if err := c.resendExpired(time.Now()); err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+func (c *dataChannel) resendExpired(now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	var seqs []int64
+	for seq, p := range c.unacknowledged {
+		if now.Sub(p.sent) >= nativeResendTimeout {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	for _, seq := range seqs {
+		p := c.unacknowledged[seq]
+		if p.attempts >= nativeResendAttempts {
+			return fmt.Errorf("the SSM agent did not acknowledge input message %d after %d attempts", seq, p.attempts)
+		}
+		logger.Debugf("sending input message %d again", seq)
+		p.sent = now
+		p.attempts++
+		err := websocket.Message.Send(c.ws, p.data)
+		if err != nil {
+			return fmt.Errorf("failed to send input message %d again: %v", seq, err)
+		}
+	}
+	return nil
+}
+
+func (c *dataChannel) sendInput(payloadType uint32, payload []byte) error {
+	return c.send(&agentMessage{
+		Type:        msgInputStreamData,
+		Id:          newMessageId(),
+		PayloadType: payloadType,
+		Payload:     payload,
+	})
+}
+
+func (c *dataChannel) acknowledge(m *agentMessage) error {
+	b, err := json.Marshal(map[string]interface{}{
+		"AcknowledgedMessageType":           m.Type,
+		"AcknowledgedMessageId":             m.uuid(),
+		"AcknowledgedMessageSequenceNumber": m.Sequence,
+		"IsSequentialMessage":               true,
+	})
+	if err != nil {
+		return err
+	}
+	return c.send(&agentMessage{Type: msgAcknowledge, Flags: 3, Id: newMessageId(), Payload: b})
+}
+
+// ping keeps the websocket from being closed as idle, as the plugin does.
+func (c *dataChannel) ping(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+		c.ws.PayloadType = websocket.PingFrame
+		_, err := c.ws.Write([]byte("keepalive"))
+		c.ws.PayloadType = websocket.BinaryFrame
+		c.mu.Unlock()
+		if err != nil {
+			logger.Debugf("failed to ping the data channel: %v", err)
+			return
+		}
+	}
+}
+
+// copyInput sends the stdin in payloads up to the size once the handshake is
+// complete, and terminates the session at the end of it. The input is left
+// unread when the handshake fails or times out.
+func (c *dataChannel) copyInput(in io.Reader, size int) {
+	timer := time.NewTimer(nativeHandshakeTimeout)
+	defer timer.Stop()
+	select {
+	case <-c.handshaken:
+	case <-c.done:
+		return
+	case <-timer.C:
+		c.fail(fmt.Errorf("the handshake with the SSM agent did not complete within %s", nativeHandshakeTimeout))
+		return
+	}
+	buf := make([]byte, size)
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			c.waitAcknowledged()
+			if serr := c.sendInput(payloadOutput, append([]byte(nil), buf[:n]...)); serr != nil {
+				return
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if compareVersions(c.agentVersion, terminateFlagAgentVersion) >= 0 {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, flagTerminateSession)
+		_ = c.sendInput(payloadFlag, b)
+	} else {
+		c.close()
+	}
+}
+
+// receive processes the agent messages until the channel is closed.
+func (c *dataChannel) receive() error {
+	for {
+		var b []byte
+		err := websocket.Message.Receive(c.ws, &b)
+		if errors.Is(err, io.EOF) || c.isClosed() {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("data channel failed: %v", err)
+		}
+		m, err := unmarshalAgentMessage(b)
+		if err != nil {
+			return err
+		}
+
+		switch m.Type {
+		case msgOutputStreamData:
+			err = c.receiveOutput(m)
+		case msgAcknowledge:
+			c.receiveAcknowledge(m)
+		case msgChannelClosed:
+			return c.channelClosed(m)
+		default:
+			// start or pause publication
+			logger.Debugf("ignored %s message", m.Type)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *dataChannel) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *dataChannel) receiveOutput(m *agentMessage) error {
+	err := c.acknowledge(m)
+	if err != nil {
+		return err
+	}
+	if m.Sequence < c.expected {
+		// resent as our acknowledge was not received
+		return nil
+	}
+	c.early[m.Sequence] = m
+	for {
+		m, ok := c.early[c.expected]
+		if !ok {
+			return nil
+		}
+		delete(c.early, c.expected)
+		c.expected++
+		err = c.processOutput(m)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *dataChannel) processOutput(m *agentMessage) error {
+	switch m.PayloadType {
+	case payloadOutput:
+		_, err := c.out.Write(m.Payload)
+		return err
+	case payloadError, payloadStdErr:
+		logger.Warnf("%s", strings.TrimSpace(string(m.Payload)))
+		return nil
+	case payloadHandshakeRequest:
+		return c.handshake(m.Payload)
+	case payloadHandshakeComplete:
+		var p struct {
+			CustomerMessage string
+		}
+		_ = json.Unmarshal(m.Payload, &p)
+		if p.CustomerMessage != "" {
+			logger.Infof("%s", p.CustomerMessage)
+		}
+		logger.Debugf("handshake with agent %s is complete", c.agentVersion)
+		c.handshakeOnce.Do(func() { close(c.handshaken) })
+		return nil
+	case payloadFlag:
+		if len(m.Payload) == 4 && binary.BigEndian.Uint32(m.Payload) == flagConnectToPortError {
+			return fmt.Errorf("the SSM agent failed to connect to the port")
+		}
+		return nil
+	default:
+		logger.Debugf("ignored payload type %d", m.PayloadType)
+		return nil
+	}
+}
+
+type handshakeAction struct {
+	ActionType       string
+	ActionParameters json.RawMessage
+}
+
+type processedAction struct {
+	ActionType   string
+	ActionStatus int
+	Error        string `json:",omitempty"`
+}
+
+func (c *dataChannel) handshake(payload []byte) error {
+	var req struct {
+		AgentVersion           string
+		RequestedClientActions []handshakeAction
+	}
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid handshake request: %v", err)
+	}
+	c.agentVersion = req.AgentVersion
+
+	var processed []processedAction
+	for _, a := range req.RequestedClientActions {
+		switch a.ActionType {
+		case "SessionType":
+			var s struct {
+				SessionType string
+				Properties  struct {
+					Type string `json:"type"`
+				}
+			}
+			_ = json.Unmarshal(a.ActionParameters, &s)
+			if s.SessionType != "Port" || s.Properties.Type == "LocalPortForwarding" {
+				return fmt.Errorf("session type %s %s is not supported with --native", s.SessionType, s.Properties.Type)
+			}
+			processed = append(processed, processedAction{ActionType: a.ActionType, ActionStatus: actionStatusSuccess})
+		case "KMSEncryption":
+			return fmt.Errorf("KMS encryption of the session is not supported with --native")
+		default:
+			processed = append(processed, processedAction{
+				ActionType:   a.ActionType,
+				ActionStatus: actionStatusUnsupported,
+				Error:        fmt.Sprintf("unsupported action %s", a.ActionType),
+			})
+		}
+	}
+
+	b, err := json.Marshal(map[string]interface{}{
+		"ClientVersion":          nativeClientVersion,
+		"ProcessedClientActions": processed,
+		"Errors":                 []string{},
+	})
+	if err != nil {
+		return err
+	}
+	return c.sendInput(payloadHandshakeResponse, b)
+}
+
+func (c *dataChannel) channelClosed(m *agentMessage) error {
+	var p struct {
+		SessionId string
+		Output    string
+	}
+	_ = json.Unmarshal(m.Payload, &p)
+	if p.Output != "" {
+		logger.Infof("session %s closed: %s", p.SessionId, p.Output)
+	}
+	return nil
+}
+
+/*
+ * Agent message
+ */
+
+// agentMessage is the binary message of the data channel, whose header is
+// laid out as follows in big endian:
+//
+//	header length      4   (116, up to the payload length)
+//	message type       32  (padded with spaces)
+//	schema version     4
+//	created date       8   (epoch milliseconds)
+//	sequence number    8
+//	flags              8
+//	message id         16  (UUID with its halves swapped)
+//	payload digest     32  (SHA-256)
+//	payload type       4
+//	payload length     4
+type agentMessage struct {
+	Type        string
+	Sequence    int64
+	Flags       uint64
+	Id          [16]byte
+	PayloadType uint32
+	Payload     []byte
+}
+
+const agentMessageHeaderLength = 116
+
+func (m *agentMessage) marshal() []byte {
+	b := make([]byte, agentMessageHeaderLength+4+len(m.Payload))
+	binary.BigEndian.PutUint32(b[0:], agentMessageHeaderLength)
+	copy(b[4:36], fmt.Sprintf("%-32s", m.Type))
+	binary.BigEndian.PutUint32(b[36:], 1)
+	binary.BigEndian.PutUint64(b[40:], uint64(time.Now().UnixMilli()))
+	binary.BigEndian.PutUint64(b[48:], uint64(m.Sequence))
+	binary.BigEndian.PutUint64(b[56:], m.Flags)
+	copy(b[64:72], m.Id[8:])
+	copy(b[72:80], m.Id[:8])
+	digest := sha256.Sum256(m.Payload)
+	copy(b[80:112], digest[:])
+	binary.BigEndian.PutUint32(b[112:], m.PayloadType)
+	binary.BigEndian.PutUint32(b[116:], uint32(len(m.Payload)))
+	copy(b[120:], m.Payload)
+	return b
+}
+
+func unmarshalAgentMessage(b []byte) (*agentMessage, error) {
+	if len(b) < agentMessageHeaderLength+4 {
+		return nil, fmt.Errorf("invalid data channel message of %d bytes", len(b))
+	}
+	hl := int(binary.BigEndian.Uint32(b[0:]))
+	if hl < agentMessageHeaderLength || len(b) < hl+4 {
+		return nil, fmt.Errorf("invalid data channel message header length %d", hl)
+	}
+	n := int(binary.BigEndian.Uint32(b[hl:]))
+	if len(b) < hl+4+n {
+		return nil, fmt.Errorf("invalid data channel message payload length %d", n)
+	}
+	m := &agentMessage{
+		Type:        strings.TrimRight(string(b[4:36]), " \x00"),
+		Sequence:    int64(binary.BigEndian.Uint64(b[48:])),
+		Flags:       binary.BigEndian.Uint64(b[56:]),
+		PayloadType: binary.BigEndian.Uint32(b[112:]),
+		Payload:     b[hl+4 : hl+4+n],
+	}
+	copy(m.Id[8:], b[64:72])
+	copy(m.Id[:8], b[72:80])
+	return m, nil
+}
+
+func (m *agentMessage) uuid() string {
+	return formatUuid(m.Id)
+}
+
+func newMessageId() [16]byte {
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return id
+}
+
+func newUuid() string {
+	return formatUuid(newMessageId())
+}
+
+func formatUuid(id [16]byte) string {
+	s := hex.EncodeToString(id[:])
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
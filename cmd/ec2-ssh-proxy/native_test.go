@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"golang.org/x/net/websocket"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestChannel returns an opened data channel connected to a websocket
+// server, which passes the messages it receives to the returned channel.
+func newTestChannel(t *testing.T) (*dataChannel, *bytes.Buffer, chan *agentMessage) {
+	t.Helper()
+	received := make(chan *agentMessage, 100)
+	s := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		for {
+			var b []byte
+			if err := websocket.Message.Receive(ws, &b); err != nil {
+				return
+			}
+			// the first message is the JSON opening the channel
+			m, err := unmarshalAgentMessage(b)
+			if err == nil {
+				received <- m
+			}
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(s.URL, "http"), "", "http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	c := &dataChannel{ws: ws, out: out, done: make(chan struct{})}
+	t.Cleanup(c.close)
+	err = c.open("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, out, received
+}
+
+func receiveMessage(t *testing.T, received chan *agentMessage) *agentMessage {
+	t.Helper()
+	select {
+	case m := <-received:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message is sent")
+		return nil
+	}
+}
+
+func TestAgentMessageRoundTrip(t *testing.T) {
+	m := &agentMessage{
+		Type:        msgInputStreamData,
+		Sequence:    42,
+		Flags:       3,
+		Id:          newMessageId(),
+		PayloadType: payloadOutput,
+		Payload:     []byte("hello"),
+	}
+	b := m.marshal()
+
+	if len(b) != agentMessageHeaderLength+4+len(m.Payload) {
+		t.Fatalf("message length = %d", len(b))
+	}
+	if n := binary.BigEndian.Uint32(b[0:]); n != agentMessageHeaderLength {
+		t.Errorf("header length = %d, want %d", n, agentMessageHeaderLength)
+	}
+	if typ := string(b[4:36]); typ != msgInputStreamData+strings.Repeat(" ", 32-len(msgInputStreamData)) {
+		t.Errorf("message type = %q", typ)
+	}
+	if v := binary.BigEndian.Uint32(b[36:]); v != 1 {
+		t.Errorf("schema version = %d, want 1", v)
+	}
+	if seq := binary.BigEndian.Uint64(b[48:]); seq != 42 {
+		t.Errorf("sequence number = %d, want 42", seq)
+	}
+	if flags := binary.BigEndian.Uint64(b[56:]); flags != 3 {
+		t.Errorf("flags = %d, want 3", flags)
+	}
+	// the halves of the message id are swapped
+	if !bytes.Equal(b[64:72], m.Id[8:]) || !bytes.Equal(b[72:80], m.Id[:8]) {
+		t.Errorf("message id = %x, want the halves of %x swapped", b[64:80], m.Id)
+	}
+	if digest := sha256.Sum256(m.Payload); !bytes.Equal(b[80:112], digest[:]) {
+		t.Errorf("payload digest = %x, want %x", b[80:112], digest)
+	}
+	if typ := binary.BigEndian.Uint32(b[112:]); typ != payloadOutput {
+		t.Errorf("payload type = %d, want %d", typ, payloadOutput)
+	}
+	if n := binary.BigEndian.Uint32(b[116:]); n != uint32(len(m.Payload)) {
+		t.Errorf("payload length = %d, want %d", n, len(m.Payload))
+	}
+
+	got, err := unmarshalAgentMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != m.Type || got.Sequence != m.Sequence || got.Flags != m.Flags || got.Id != m.Id ||
+		got.PayloadType != m.PayloadType || !bytes.Equal(got.Payload, m.Payload) {
+		t.Errorf("unmarshalAgentMessage() = %+v, want %+v", got, m)
+	}
+	if got.uuid() != formatUuid(m.Id) {
+		t.Errorf("uuid() = %s, want %s", got.uuid(), formatUuid(m.Id))
+	}
+
+	for _, b := range [][]byte{b[:agentMessageHeaderLength], b[:len(b)-1]} {
+		_, err = unmarshalAgentMessage(b)
+		if err == nil {
+			t.Errorf("unmarshalAgentMessage() of %d bytes is not an error", len(b))
+		}
+	}
+}
+
+func TestReceiveOutputOrder(t *testing.T) {
+	c, out, received := newTestChannel(t)
+	output := func(seq int64, s string) *agentMessage {
+		return &agentMessage{Type: msgOutputStreamData, Sequence: seq, Id: newMessageId(), PayloadType: payloadOutput, Payload: []byte(s)}
+	}
+	for _, m := range []*agentMessage{output(1, "b"), output(0, "a"), output(0, "a"), output(3, "d"), output(2, "c"), output(1, "b")} {
+		err := c.receiveOutput(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// every message is acknowledged, including the resent ones
+		ack := receiveMessage(t, received)
+		var p struct {
+			AcknowledgedMessageSequenceNumber int64
+		}
+		_ = json.Unmarshal(ack.Payload, &p)
+		if ack.Type != msgAcknowledge || p.AcknowledgedMessageSequenceNumber != m.Sequence {
+			t.Errorf("acknowledge = %s of %d, want of %d", ack.Type, p.AcknowledgedMessageSequenceNumber, m.Sequence)
+		}
+	}
+	if out.String() != "abcd" {
+		t.Errorf("output = %q, want abcd", out.String())
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	request := func(actions ...string) []byte {
+		return []byte(`{"AgentVersion": "3.0.0.0", "RequestedClientActions": [` + strings.Join(actions, ",") + `]}`)
+	}
+	port := `{"ActionType": "SessionType", "ActionParameters": {"SessionType": "Port", "Properties": {"portNumber": "22"}}}`
+	tests := []struct {
+		name    string
+		payload []byte
+		ok      bool
+	}{
+		{"port", request(port), true},
+		{"unknown action", request(port, `{"ActionType": "Unknown"}`), true},
+		{"KMS", request(`{"ActionType": "KMSEncryption", "ActionParameters": {"KMSKeyId": "alias/key"}}`, port), false},
+		{"local port forwarding", request(`{"ActionType": "SessionType", "ActionParameters": {"SessionType": "Port", "Properties": {"type": "LocalPortForwarding"}}}`), false},
+		{"shell", request(`{"ActionType": "SessionType", "ActionParameters": {"SessionType": "Standard_Stream"}}`), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _, received := newTestChannel(t)
+			err := c.handshake(tt.payload)
+			if (err == nil) != tt.ok {
+				t.Fatalf("handshake() = %v, want ok %v", err, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+			m := receiveMessage(t, received)
+			if m.PayloadType != payloadHandshakeResponse {
+				t.Errorf("payload type = %d, want %d", m.PayloadType, payloadHandshakeResponse)
+			}
+			if c.agentVersion != "3.0.0.0" {
+				t.Errorf("agentVersion = %q, want 3.0.0.0", c.agentVersion)
+			}
+		})
+	}
+}
+
+func TestHandshakeCompleteTwice(t *testing.T) {
+	c, _, _ := newTestChannel(t)
+	for i := 0; i < 2; i++ {
+		err := c.processOutput(&agentMessage{PayloadType: payloadHandshakeComplete, Payload: []byte("{}")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-c.handshaken:
+	default:
+		t.Errorf("the handshake is not complete")
+	}
+}
+
+func TestResendExpired(t *testing.T) {
+	c, _, received := newTestChannel(t)
+	err := c.sendInput(payloadOutput, []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiveMessage(t, received)
+
+	now := time.Now()
+	err = c.resendExpired(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-received:
+		t.Errorf("input message %d is sent again before the timeout", m.Sequence)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	now = now.Add(nativeResendTimeout)
+	err = c.resendExpired(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := receiveMessage(t, received); m.Sequence != 0 || string(m.Payload) != "a" {
+		t.Errorf("sent again %d %q, want 0 %q", m.Sequence, m.Payload, "a")
+	}
+
+	// it gives up after the attempts
+	for i := 2; i < nativeResendAttempts; i++ {
+		now = now.Add(nativeResendTimeout)
+		err = c.resendExpired(now)
+		if err != nil {
+			t.Fatalf("attempt %d: %v", i+1, err)
+		}
+		receiveMessage(t, received)
+	}
+	err = c.resendExpired(now.Add(nativeResendTimeout))
+	if err == nil || !strings.Contains(err.Error(), "did not acknowledge") {
+		t.Errorf("resendExpired() = %v, want the error of the attempts", err)
+	}
+
+	// but not once acknowledged
+	c.receiveAcknowledge(&agentMessage{Type: msgAcknowledge, Payload: []byte(`{"AcknowledgedMessageSequenceNumber": 0}`)})
+	err = c.resendExpired(now.Add(nativeResendTimeout))
+	if err != nil {
+		t.Errorf("resendExpired() = %v after the acknowledge", err)
+	}
+}
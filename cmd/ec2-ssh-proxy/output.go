@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+ * JSON output
+ */
+
+// Report is what --output json prints, once the session has started, or
+// instead of the dry run.
+type Report struct {
+	InstanceId       string   `json:"instance_id"`
+	Name             string   `json:"name,omitempty"`
+	AvailabilityZone string   `json:"availability_zone"`
+	PrivateIp        string   `json:"private_ip"`
+	Region           string   `json:"region"`
+	Profile          string   `json:"profile,omitempty"`
+	Mode             string   `json:"mode"`
+	Port             int      `json:"port"`
+	LocalPort        int      `json:"local_port,omitempty"`
+	Users            []string `json:"users,omitempty"`
+	PublicKeyFile    string   `json:"public_key_file,omitempty"`
+	SessionId        string   `json:"session_id,omitempty"`
+	PluginPid        int      `json:"plugin_pid,omitempty"`
+	// dry run only
+	StartSession  *ssm.StartSessionInput `json:"start_session,omitempty"`
+	PluginCommand []string               `json:"plugin_command,omitempty"`
+}
+
+// reportWriter is stdout unless it is the session stream of ssh.
+func reportWriter(params *Params) io.Writer {
+	if params.DryRun || params.Mode != modeSSH || params.LocalForward != nil {
+		return os.Stdout
+	}
+	return os.Stderr
+}
+
+func (r *Report) print(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetEscapeHTML(false)
+	return e.Encode(r)
+}
+
+// ExpandedCommand is what --expand-only prints: the plugin command of the
+// started session, and the environment to add to ours to run it.
+type ExpandedCommand struct {
+	SessionId string   `json:"session_id"`
+	Argv      []string `json:"argv"`
+	Env       []string `json:"env,omitempty"`
+}
+
+func (e *ExpandedCommand) print(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(e)
+}
+
+// the token of StartSession is only valid long enough to open the data
+// channel, which AWS tells no more precisely
+const sessionTokenValidity = time.Minute
+
+// SessionFile is what --output-session-file writes once the session has
+// started, to resume or terminate it out of band.
+type SessionFile struct {
+	SessionId      string    `json:"session_id"`
+	StreamUrl      string    `json:"stream_url"`
+	TokenValue     string    `json:"token_value"`
+	StartedAt      time.Time `json:"started_at"`
+	TokenExpiresAt time.Time `json:"token_expires_at"`
+	InstanceId     string    `json:"instance_id"`
+	Name           string    `json:"name,omitempty"`
+	Region         string    `json:"region"`
+	Profile        string    `json:"profile,omitempty"`
+	Mode           string    `json:"mode"`
+	Port           int       `json:"port"`
+	// as passed to session-manager-plugin
+	StartSession *ssm.StartSessionInput `json:"start_session"`
+}
+
+func newSessionFile(params *Params, region string, in *ssm.StartSessionInput, out *ssm.StartSessionOutput, started time.Time) *SessionFile {
+	return &SessionFile{
+		SessionId:      aws.StringValue(out.SessionId),
+		StreamUrl:      aws.StringValue(out.StreamUrl),
+		TokenValue:     aws.StringValue(out.TokenValue),
+		StartedAt:      started.UTC(),
+		TokenExpiresAt: started.Add(sessionTokenValidity).UTC(),
+		InstanceId:     aws.StringValue(in.Target),
+		Name:           params.ResolvedName,
+		Region:         region,
+		Profile:        params.Profile,
+		Mode:           params.Mode,
+		Port:           params.Port,
+		StartSession:   in,
+	}
+}
+
+// write replaces the file at once, only readable by the user as it holds
+// the token.
+func (s *SessionFile) write(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	e := json.NewEncoder(f)
+	e.SetEscapeHTML(false)
+	e.SetIndent("", "  ")
+	err = e.Encode(s)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+/*
+ * pattern-test command
+ */
+
+// runPatternTest parses the host names as the proxy does, without calling
+// AWS, and prints what each of them selects.
+func runPatternTest(args []string) error {
+	var opts struct {
+		configOptions
+		awsOptions
+		selectorOptions
+		Args struct {
+			HOST []string `required:"yes"`
+		} `positional-args:"yes"`
+	}
+	err := parseArgsWithConfig(newParser("pattern-test", &opts), args, &opts, &opts.configOptions, &opts.awsOptions, nil)
+	if err != nil {
+		return err
+	}
+
+	base := Params{}
+	err = opts.awsOptions.apply(&base)
+	if err != nil {
+		return err
+	}
+	err = opts.selectorOptions.apply(&base)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, pattern := range opts.Pattern {
+		fmt.Fprintf(w, "%s\t%s\n", pattern, compiledPattern(pattern, !opts.Partial))
+	}
+	_ = w.Flush()
+
+	var failed int
+	for _, host := range opts.Args.HOST {
+		fmt.Printf("\n%s\n", host)
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+		p := base
+		err := opts.selectorOptions.parseHost(host, &p)
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "  error:\t%v\n", err)
+			_ = w.Flush()
+			continue
+		}
+		p.resolveProfile()
+		if pattern := matchedPattern(host, opts.Pattern, !opts.Partial, &base); pattern != "" {
+			fmt.Fprintf(w, "  pattern:\t%s\n", pattern)
+		}
+		for _, f := range [][2]string{
+			{"name", strings.Join(p.Names, ", ")},
+			{"id", p.Id},
+			{"profile", p.Profile},
+			{"region", p.Region},
+			{"private ip", p.PrivateIp},
+			{"public ip", p.PublicIp},
+			{"ipv6", p.Ipv6},
+			{"private dns", p.PrivateDns},
+		} {
+			if f[1] != "" {
+				fmt.Fprintf(w, "  %s:\t%s\n", f[0], f[1])
+			}
+		}
+		if p.EniIndex != nil {
+			fmt.Fprintf(w, "  eni:\t%s\n", strconv.Itoa(*p.EniIndex))
+		}
+		_ = w.Flush()
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d host names failed", failed, len(opts.Args.HOST))
+	}
+	return nil
+}
+
+// matchedPattern returns the first of the patterns selecting an instance by
+// the host name, as parseHostname tries them.
+func matchedPattern(hostname string, patterns []string, anchor bool, p *Params) string {
+	for _, pattern := range patterns {
+		q := *p
+		ok, err := matchHostname(hostname, pattern, anchor, &q)
+		if err == nil && ok && q.validateSelector() == nil {
+			return pattern
+		}
+	}
+	return ""
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Interactive instance picker
+ */
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+func openTTY() (*os.File, error) {
+	if runtime.GOOS == "windows" {
+		return os.Open("CONIN$")
+	}
+	return os.Open("/dev/tty")
+}
+
+// pickInstance prompts on stderr and reads the answer from the terminal,
+// so that stdin and stdout stay untouched for the SSM data stream.
+func pickInstance(ctx context.Context, instances []*ec2.Instance, nameKey string) (*ec2.Instance, error) {
+	tty, err := openTTY()
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+
+	// unblock the read below on interrupt
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = tty.Close()
+		case <-done:
+		}
+	}()
+
+	for n, i := range instances {
+		_, _ = fmt.Fprintf(os.Stderr, "%3d) %s\t%s\t%s\t%s\t%s\n",
+			n+1,
+			aws.StringValue(i.InstanceId),
+			instanceTag(i, nameKey),
+			aws.StringValue(i.PrivateIpAddress),
+			instanceAZ(i),
+			instanceState(i))
+	}
+
+	r := bufio.NewReader(tty)
+	for {
+		_, _ = fmt.Fprintf(os.Stderr, "Select an instance [1-%d]: ", len(instances))
+		line, err := r.ReadString('\n')
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("interrupted")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("no instance is selected")
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(line))
+		if err == nil && n >= 1 && n <= len(instances) {
+			return instances[n-1], nil
+		}
+	}
+}
+
+// instanceAZ and instanceState return "" when the response lacks them.
+func instanceAZ(i *ec2.Instance) string {
+	if i.Placement == nil {
+		return ""
+	}
+	return aws.StringValue(i.Placement.AvailabilityZone)
+}
+
+// instancePlacement describes the placement group and the dedicated host of
+// the instance, if any.
+func instancePlacement(i *ec2.Instance) string {
+	if i.Placement == nil {
+		return ""
+	}
+	var s []string
+	if g := aws.StringValue(i.Placement.GroupName); g != "" {
+		s = append(s, "group "+g)
+	}
+	if h := aws.StringValue(i.Placement.HostId); h != "" {
+		s = append(s, "host "+h)
+	}
+	return strings.Join(s, ", ")
+}
+
+func instanceState(i *ec2.Instance) string {
+	if i.State == nil {
+		return ""
+	}
+	return aws.StringValue(i.State.Name)
+}
+
+func instanceTag(i *ec2.Instance, key string) string {
+	for _, t := range i.Tags {
+		if aws.StringValue(t.Key) == key {
+			return aws.StringValue(t.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"time"
+)
+
+/*
+ * Pre-flight check
+ */
+
+// preflight checks that the instance is an online managed instance of SSM,
+// which otherwise only turns out when the plugin fails after the key has
+// been sent.
+func (c *Client) preflight(ctx context.Context, instanceId string) error {
+	info, err := c.instanceInformation(ctx, instanceId)
+	if err != nil {
+		return fmt.Errorf("pre-flight check failed: %v", err)
+	}
+	if info == nil {
+		return fmt.Errorf("instance is not registered with SSM (check the instance profile and SSM agent)")
+	}
+
+	status := aws.StringValue(info.PingStatus)
+	if status != ssm.PingStatusOnline {
+		return fmt.Errorf("the SSM agent of the instance is %s since %s (check the SSM agent)",
+			status, aws.TimeValue(info.LastPingDateTime).Format(time.RFC3339))
+	}
+	logger.Infof("instance is online in SSM (agent %s)", aws.StringValue(info.AgentVersion))
+	return nil
+}
+
+// waitForSSM polls until the SSM agent of the instance has registered and is
+// online, as it may take a while after the instance boots.
+func (c *Client) waitForSSM(ctx context.Context, params *Params, instanceId string) error {
+	ctx, cancel := context.WithTimeout(ctx, params.WaitTimeout)
+	defer cancel()
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+
+	status := "not registered"
+	for {
+		info, err := c.instanceInformation(ctx, instanceId)
+		if err != nil && ctx.Err() == nil {
+			return fmt.Errorf("failed waiting for the SSM agent of %s: %v", instanceId, err)
+		}
+		if info != nil {
+			status = aws.StringValue(info.PingStatus)
+			if status == ssm.PingStatusOnline {
+				logger.Infof("instance is online in SSM (agent %s)", aws.StringValue(info.AgentVersion))
+				return nil
+			}
+		}
+		logger.Infof("waiting for the SSM agent of %s to be online (%s)", instanceId, status)
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("timed out after %s waiting for the SSM agent of %s to be online (%s)", params.WaitTimeout, instanceId, status)
+			}
+			return fmt.Errorf("interrupted")
+		}
+	}
+}
+
+// instanceInformation returns nil if the instance is not a managed instance.
+func (c *Client) instanceInformation(ctx context.Context, instanceId string) (*ssm.InstanceInformation, error) {
+	var out *ssm.DescribeInstanceInformationOutput
+	err := c.call(ctx, func(ctx aws.Context) (err error) {
+		out, err = c.ssm.DescribeInstanceInformationWithContext(ctx, &ssm.DescribeInstanceInformationInput{
+			Filters: []*ssm.InstanceInformationStringFilter{
+				{
+					Key:    aws.String("InstanceIds"),
+					Values: []*string{aws.String(instanceId)},
+				},
+			},
+		})
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.InstanceInformationList) == 0 {
+		return nil, nil
+	}
+	return out.InstanceInformationList[0], nil
+}
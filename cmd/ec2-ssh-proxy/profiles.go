@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Profile fan-out
+ */
+
+var errInstanceNotFound = errors.New("ec2 instance is not found")
+
+// A profile where the instance is not found is remembered for a short time,
+// so that reconnecting does not look it up in every profile again.
+const missingCacheTTL = 30 * time.Second
+
+type profileResult struct {
+	client   *Client
+	params   *Params
+	instance *ec2.Instance
+	err      error
+}
+
+// findInProfiles looks up the instance with each of params.Profiles in
+// parallel, and returns the client and the params of the only profile where
+// it is found.
+func findInProfiles(ctx context.Context, params *Params) (*Client, *Params, *ec2.Instance, error) {
+	results := make([]profileResult, len(params.Profiles))
+	var wg sync.WaitGroup
+	for n, profile := range params.Profiles {
+		q := *params
+		q.Profile = profile
+		q.ProfileFlag = true
+		q.Profiles = nil
+		// do not prompt for several profiles at once
+		q.Interactive = false
+		results[n].params = &q
+
+		wg.Add(1)
+		go func(r *profileResult) {
+			defer wg.Done()
+			r.client, r.err = newClient(r.params)
+			if r.err == nil {
+				r.instance, r.err = r.client.findInstanceOrMissing(ctx, r.params)
+			}
+		}(&results[n])
+	}
+	wg.Wait()
+
+	var found []profileResult
+	var failed []string
+	for _, r := range results {
+		switch {
+		case r.err == nil:
+			found = append(found, r)
+		case errors.Is(r.err, errInstanceNotFound):
+			logger.Infof("the instance is not found in profile %s", r.params.Profile)
+		default:
+			logger.Warnf("failed to look up the instance in profile %s: %v", r.params.Profile, r.err)
+			failed = append(failed, r.params.Profile)
+		}
+	}
+
+	switch {
+	case len(found) == 1:
+		r := found[0]
+		logger.Infof("found the instance in profile %s", r.params.Profile)
+		logger.SetField("profile", r.params.Profile)
+		logger.SetField("region", r.client.region)
+		return r.client, r.params, r.instance, nil
+	case len(found) > 1:
+		var a []string
+		for _, r := range found {
+			a = append(a, fmt.Sprintf("%s (%s)", r.params.Profile, aws.StringValue(r.instance.InstanceId)))
+		}
+		return nil, nil, nil, fmt.Errorf("the instance is found in more than one profile: %s", strings.Join(a, ", "))
+	case len(failed) > 0:
+		return nil, nil, nil, fmt.Errorf("ec2 instance is not found, and the lookup failed in profiles: %s", strings.Join(failed, ", "))
+	default:
+		return nil, nil, nil, fmt.Errorf("ec2 instance is not found in any of the profiles: %s", strings.Join(params.Profiles, ", "))
+	}
+}
+
+// findInstanceOrMissing is findInstance remembering where the instance is
+// not found.
+func (c *Client) findInstanceOrMissing(ctx context.Context, params *Params) (*ec2.Instance, error) {
+	key := newCacheKey(params, c.region)
+	if c.cache != nil && c.cache.missing(key) {
+		logger.Infof("the instance is cached as missing in profile %s", params.Profile)
+		return nil, errInstanceNotFound
+	}
+	i, err := c.findInstance(ctx, params)
+	if errors.Is(err, errInstanceNotFound) && c.cache != nil {
+		c.cache.putMissing(key, missingCacheTTL)
+	}
+	return i, err
+}
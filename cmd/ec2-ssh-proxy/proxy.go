@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/net/http/httpproxy"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+/*
+ * HTTPS proxy
+ */
+
+// validateProxy checks the URL of --https-proxy.
+func validateProxy(proxy string) error {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return fmt.Errorf("invalid proxy URL %s: %v", proxy, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid proxy URL %s, which must be http://host:port or https://host:port", proxy)
+	}
+	return nil
+}
+
+// proxyHTTPClient returns the client of the SDK sending the requests through
+// the proxy, except to the hosts in NO_PROXY and to localhost, like the
+// SDK does with HTTPS_PROXY.
+func proxyHTTPClient(proxy string) *http.Client {
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	c := httpproxy.Config{HTTPProxy: proxy, HTTPSProxy: proxy, NoProxy: noProxy}
+	f := c.ProxyFunc()
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = func(r *http.Request) (*url.URL, error) {
+		return f(r.URL)
+	}
+	return &http.Client{Transport: t}
+}
+
+// proxyEnv hands the proxy over to session-manager-plugin and the AWS CLI,
+// which read it from the environment. NO_PROXY is inherited as is.
+func proxyEnv(params *Params) []string {
+	if params.HTTPSProxy == "" {
+		return nil
+	}
+	return []string{"HTTPS_PROXY=" + params.HTTPSProxy, "https_proxy=" + params.HTTPSProxy}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Resolver command
+ */
+
+// resolveWithCommand runs --resolver-command with HOST and PORT as the
+// arguments, and returns the params selecting the instance it prints by ID.
+//
+// The command reads nothing from stdin, which is the stream of ssh, and its
+// stderr is passed through. On success, it exits with 0 printing a line of
+// the instance ID, optionally followed by the region and the profile to
+// connect with, where - keeps the configured one:
+//
+//	i-0123456789abcdef0 ap-northeast-1 prod
+//
+// Any other exit status fails the connection.
+func resolveWithCommand(ctx context.Context, params *Params) (*Params, error) {
+	cmd := exec.CommandContext(ctx, params.ResolverCommand, params.Host, strconv.Itoa(params.Port))
+	cmd.Env = append(os.Environ(),
+		"EC2_SSH_PROXY_PROFILE="+params.Profile,
+		"EC2_SSH_PROXY_REGION="+params.Region,
+		"EC2_SSH_PROXY_MODE="+params.Mode,
+	)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	logger.Debugf("running the resolver command %s %s %d", params.ResolverCommand, params.Host, params.Port)
+	err := cmd.Run()
+	var eerr *exec.ExitError
+	if errors.As(err, &eerr) {
+		return nil, fmt.Errorf("resolver command %s failed for %s with exit status %d", params.ResolverCommand, params.Host, eerr.ExitCode())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to run the resolver command: %v", err)
+	}
+
+	line := strings.TrimSpace(out.String())
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("resolver command %s printed no instance for %s", params.ResolverCommand, params.Host)
+	}
+	if len(fields) > 3 || !instanceIdPattern.MatchString(fields[0]) {
+		return nil, fmt.Errorf("resolver command %s printed an invalid line: %q (expected INSTANCE_ID [REGION [PROFILE]])", params.ResolverCommand, line)
+	}
+
+	q := *params
+	q.Id = fields[0]
+	if len(fields) > 1 && fields[1] != "-" {
+		q.Region = fields[1]
+	}
+	if len(fields) > 2 && fields[2] != "-" {
+		q.Profile = fields[2]
+		q.ProfileFromHost = true
+	}
+	logger.Infof("resolver command resolved %s to %s", params.Host, q.Id)
+	return &q, nil
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ssocreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sso"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * AWS session
+ */
+
+func newSession(params *Params) (*session.Session, error) {
+	// The default retryer backs off with jitter on throttling and transient
+	// errors only. The delays are capped as the whole call is bounded by
+	// --aws-timeout anyway.
+	cfg := aws.Config{
+		Retryer: client.DefaultRetryer{
+			NumMaxRetries:    params.MaxRetries,
+			MaxRetryDelay:    10 * time.Second,
+			MaxThrottleDelay: 10 * time.Second,
+		},
+	}
+	region, source := resolveRegion(params)
+	if region != "" {
+		logger.Infof("using region %s from %s", region, source)
+		cfg.Region = aws.String(region)
+	}
+	// AWS_USE_FIPS_ENDPOINT is honored by the SDK as well, and the FIPS
+	// SSM endpoint is then handed to session-manager-plugin too
+	if params.FIPS {
+		cfg.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	if params.HTTPSProxy != "" {
+		logger.Infof("using the proxy %s", params.HTTPSProxy)
+		cfg.HTTPClient = proxyHTTPClient(params.HTTPSProxy)
+	}
+	opts := session.Options{
+		Config:                  cfg,
+		Profile:                 params.Profile,
+		SharedConfigState:       session.SharedConfigEnable,
+		AssumeRoleTokenProvider: mfaTokenProvider,
+	}
+	if params.NoMFAPrompt {
+		opts.AssumeRoleTokenProvider = noMFATokenProvider
+	}
+	if params.AWSConfigFile != "" || params.AWSCredentialsFile != "" {
+		credentialsFile, configFile, err := sharedFiles(params)
+		if err != nil {
+			return nil, err
+		}
+		logger.Debugf("shared credentials file=%s config file=%s", credentialsFile, configFile)
+		opts.SharedConfigFiles = []string{credentialsFile, configFile}
+	}
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	sess.Handlers.Complete.PushBack(logRequest)
+	logger.Debugf("region=%s profile=%s", aws.StringValue(sess.Config.Region), params.Profile)
+
+	// Resolve credentials up front, so that an expired SSO session is
+	// reported as such instead of failing the first API call.
+	_, err = sess.Config.Credentials.Get()
+	if isSSOTokenError(err) && params.SSOLogin {
+		logger.Infof("the SSO session has expired, running aws sso login")
+		err = ssoLogin(params.Profile, append(sharedFilesEnv(params), proxyEnv(params)...))
+		if err != nil {
+			return nil, err
+		}
+		sess.Config.Credentials.Expire()
+		_, err = sess.Config.Credentials.Get()
+	}
+	if isSSOTokenError(err) {
+		return nil, fmt.Errorf("the SSO session has expired or is invalid, run `aws sso login%s`", profileOption(params.Profile))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve AWS credentials: %v", err)
+	}
+
+	if params.AssumeRole != "" {
+		logger.Infof("assuming role %s", params.AssumeRole)
+		creds := stscreds.NewCredentials(sess, params.AssumeRole, func(p *stscreds.AssumeRoleProvider) {
+			if params.ExternalId != "" {
+				p.ExternalID = aws.String(params.ExternalId)
+			}
+			if params.RoleSessionName != "" {
+				p.RoleSessionName = params.RoleSessionName
+			}
+			for _, t := range params.SessionTags {
+				p.Tags = append(p.Tags, &sts.Tag{Key: aws.String(t.Key), Value: aws.String(t.Value)})
+			}
+			if params.SourceIdentity != "" {
+				p.SourceIdentity = aws.String(params.SourceIdentity)
+			}
+		})
+		_, err = creds.Get()
+		if err != nil {
+			return nil, fmt.Errorf("failed to assume role %s: %v", params.AssumeRole, err)
+		}
+		sess = sess.Copy(&aws.Config{Credentials: creds})
+	}
+
+	return sess, nil
+}
+
+// resolveProfile makes the profile explicit, so that the SDK and the plugin
+// surely use the same one. --profile and the host name have been applied
+// already. Without a profile, the SDK takes the credentials in the
+// environment variables, of the web identity or of the container over the
+// default profile, so it is left empty for them unless the default profile
+// exists, and the plugin is given "default" instead.
+func (p *Params) resolveProfile() {
+	if p.Profile != "" {
+		return
+	}
+	for _, k := range []string{"AWS_PROFILE", "AWS_DEFAULT_PROFILE"} {
+		if v := os.Getenv(k); v != "" {
+			p.Profile = v
+			return
+		}
+	}
+	if k := envCredentialsSource(); k != "" && !sharedProfileExists(p, "default") {
+		logger.Debugf("using the credentials given by %s", k)
+		return
+	}
+	p.Profile = "default"
+}
+
+// envCredentialsSource returns the environment variable giving the
+// credentials without a profile, if any.
+func envCredentialsSource() string {
+	for _, k := range []string{
+		"AWS_ACCESS_KEY_ID",
+		"AWS_WEB_IDENTITY_TOKEN_FILE",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI",
+	} {
+		if os.Getenv(k) != "" {
+			return k
+		}
+	}
+	return ""
+}
+
+// envCredentialsIdentity identifies the credentials of the environment, which
+// no profile names, by the access key ID, the role or the endpoint, so that
+// what is cached for one account is not used for another.
+func envCredentialsIdentity() string {
+	switch k := envCredentialsSource(); k {
+	case "":
+		return ""
+	case "AWS_WEB_IDENTITY_TOKEN_FILE":
+		return k + "=" + os.Getenv("AWS_ROLE_ARN")
+	default:
+		return k + "=" + os.Getenv(k)
+	}
+}
+
+// resolveRegion returns the region and where it comes from. As the SDK does,
+// AWS_REGION and AWS_DEFAULT_REGION take precedence over the region of the
+// profile, unless the profile is chosen by --profile or the host name, so
+// that such a profile always queries its own region.
+func resolveRegion(params *Params) (string, string) {
+	if params.Region != "" {
+		return params.Region, "--region or the host name"
+	}
+	explicit := params.ProfileFlag || params.ProfileFromHost
+	if !explicit {
+		if k, v := lookupRegionEnv(); v != "" {
+			return v, k
+		}
+	}
+	if params.Profile != "" {
+		path, region, err := sharedConfigRegion(params)
+		if err != nil {
+			logger.Infof("failed to read the region of profile %s: %v", params.Profile, err)
+		}
+		if region != "" {
+			return region, fmt.Sprintf("profile %s in %s", params.Profile, path)
+		}
+	}
+	if k, v := lookupRegionEnv(); v != "" {
+		return v, k
+	}
+	return "", ""
+}
+
+// lookupRegionEnv returns the first of AWS_REGION and AWS_DEFAULT_REGION set.
+func lookupRegionEnv() (string, string) {
+	for _, k := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if v := os.Getenv(k); v != "" {
+			return k, v
+		}
+	}
+	return "", ""
+}
+
+// sharedFiles returns the shared credentials and config files, given by
+// --aws-credentials-file and --aws-config-file, or else by the environment
+// variables or the defaults as the SDK does.
+func sharedFiles(params *Params) (string, string, error) {
+	files := []struct {
+		flag string
+		env  string
+		name string
+	}{
+		{params.AWSCredentialsFile, "AWS_SHARED_CREDENTIALS_FILE", "credentials"},
+		{params.AWSConfigFile, "AWS_CONFIG_FILE", "config"},
+	}
+	var ret []string
+	for _, f := range files {
+		path := f.flag
+		if path == "" {
+			path = os.Getenv(f.env)
+		}
+		if path == "" {
+			path = filepath.Join("~", ".aws", f.name)
+		}
+		path, err := expandPath(path)
+		if err != nil {
+			return "", "", err
+		}
+		ret = append(ret, path)
+	}
+	return ret[0], ret[1], nil
+}
+
+// sharedFilesEnv returns the environment variables that point
+// session-manager-plugin and the AWS CLI at the files given by the options.
+func sharedFilesEnv(params *Params) []string {
+	var env []string
+	if params.AWSCredentialsFile != "" {
+		if p, err := expandPath(params.AWSCredentialsFile); err == nil {
+			env = append(env, "AWS_SHARED_CREDENTIALS_FILE="+p)
+		}
+	}
+	if params.AWSConfigFile != "" {
+		if p, err := expandPath(params.AWSConfigFile); err == nil {
+			env = append(env, "AWS_CONFIG_FILE="+p)
+		}
+	}
+	return env
+}
+
+// sharedConfigRegion reads the region of the profile from the shared config
+// file. A missing file just has no region.
+func sharedConfigRegion(params *Params) (string, string, error) {
+	_, path, err := sharedFiles(params)
+	if err != nil {
+		return "", "", err
+	}
+	sections, err := readSharedFile(path)
+	if err != nil {
+		return path, "", err
+	}
+	return path, sections[configSection(params.Profile)]["region"], nil
+}
+
+// sharedProfileExists tells whether the profile is in the shared credentials
+// or config file.
+func sharedProfileExists(params *Params, profile string) bool {
+	credentialsPath, configPath, err := sharedFiles(params)
+	if err != nil {
+		return false
+	}
+	credentials, err := readSharedFile(credentialsPath)
+	if err != nil {
+		logger.Infof("failed to read %s: %v", credentialsPath, err)
+	}
+	config, err := readSharedFile(configPath)
+	if err != nil {
+		logger.Infof("failed to read %s: %v", configPath, err)
+	}
+	_, inCredentials := credentials[profile]
+	_, inConfig := config[configSection(profile)]
+	return inCredentials || inConfig
+}
+
+// sharedProfiles returns the names of the profiles in the shared files,
+// sorted.
+func sharedProfiles(params *Params) []string {
+	credentialsPath, configPath, err := sharedFiles(params)
+	if err != nil {
+		return nil
+	}
+	credentials, _ := readSharedFile(credentialsPath)
+	config, _ := readSharedFile(configPath)
+	var ret []string
+	for name := range credentials {
+		ret = append(ret, name)
+	}
+	for name := range config {
+		// other sections are sso-session, services and so on
+		if name != "default" && !strings.HasPrefix(name, "profile ") {
+			continue
+		}
+		name = strings.TrimPrefix(name, "profile ")
+		if _, ok := credentials[name]; !ok {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// configSection returns the section of the profile in the shared config
+// file, where the default profile may be written either way.
+func configSection(profile string) string {
+	if profile == "default" {
+		return profile
+	}
+	return "profile " + profile
+}
+
+// readSharedFile reads the top-level settings of each section of the shared
+// credentials or config file. A missing file has no sections.
+func readSharedFile(path string) (map[string]map[string]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sections := map[string]map[string]string{}
+	var section map[string]string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		// indented lines are nested settings, such as those of s3
+		if line == "" || line[0] == '#' || line[0] == ';' || line != strings.TrimLeft(s.Text(), " \t") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.Join(strings.Fields(line[1:len(line)-1]), " ")
+			if name == "profile default" {
+				name = "default"
+			}
+			if sections[name] == nil {
+				sections[name] = map[string]string{}
+			}
+			section = sections[name]
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if ok && section != nil {
+			section[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return sections, s.Err()
+}
+
+var mfaMutex sync.Mutex
+
+func noMFATokenProvider() (string, error) {
+	return "", fmt.Errorf("the profile requires an MFA token code, which is not prompted for here")
+}
+
+// mfaTokenProvider prompts for the MFA code of profiles with mfa_serial on
+// stderr and reads it from the terminal, as stdin and stdout are the SSH
+// connection. Without a terminal it falls back to stdin.
+func mfaTokenProvider() (string, error) {
+	// the profiles of --profiles are resolved in parallel
+	mfaMutex.Lock()
+	defer mfaMutex.Unlock()
+
+	if logger.quiet() {
+		return "", fmt.Errorf("the profile requires an MFA token code, which is not prompted for with --quiet")
+	}
+	tty, err := openTTY()
+	if err != nil {
+		return stscreds.StdinTokenProvider()
+	}
+	defer tty.Close()
+
+	_, _ = fmt.Fprint(os.Stderr, "Assume Role MFA token code: ")
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read the MFA token code: %v", err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// credentialsEnv returns the environment variables that make the AWS SDK
+// default credential chain pick up v.
+func credentialsEnv(v credentials.Value) []string {
+	return []string{
+		"AWS_PROFILE=",
+		"AWS_ACCESS_KEY_ID=" + v.AccessKeyID,
+		"AWS_SECRET_ACCESS_KEY=" + v.SecretAccessKey,
+		"AWS_SESSION_TOKEN=" + v.SessionToken,
+	}
+}
+
+// isSSOTokenError reports whether err is caused by a missing or expired SSO
+// token. The token provider for sso_session profiles returns plain errors,
+// so their messages are checked as well.
+func isSSOTokenError(err error) bool {
+	for err != nil {
+		if strings.Contains(err.Error(), "SSO token") {
+			return true
+		}
+		aerr, ok := err.(awserr.Error)
+		if !ok {
+			return false
+		}
+		switch aerr.Code() {
+		case ssocreds.ErrCodeSSOProviderInvalidToken, sso.ErrCodeUnauthorizedException:
+			return true
+		}
+		err = aerr.OrigErr()
+	}
+	return false
+}
+
+// ssoLogin runs `aws sso login`, which opens the browser to refresh the
+// cached SSO token. Its output goes to stderr to keep stdout clean.
+func ssoLogin(profile string, env []string) error {
+	args := []string{"sso", "login"}
+	if profile != "" {
+		args = append(args, "--profile", profile)
+	}
+	cmd := exec.Command("aws", args...)
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("aws sso login failed: %v", err)
+	}
+	return nil
+}
+
+func profileOption(profile string) string {
+	if profile == "" {
+		return ""
+	}
+	return " --profile " + profile
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2instanceconnect"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setSharedConfig points the SDK at a temporary shared config file with the
+// content, and clears the AWS variables of the environment.
+func setSharedConfig(t *testing.T, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config")
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", dir)
+	t.Setenv("AWS_CONFIG_FILE", path)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	for _, k := range []string{"AWS_PROFILE", "AWS_DEFAULT_PROFILE", "AWS_REGION", "AWS_DEFAULT_REGION", "AWS_ACCESS_KEY_ID", "AWS_SDK_LOAD_CONFIG",
+		"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI"} {
+		t.Setenv(k, "")
+		os.Unsetenv(k)
+	}
+	return path
+}
+
+const testSharedConfig = `[default]
+region = us-west-2
+
+[profile prod]
+region = eu-west-1
+
+[profile dev]
+source_profile = prod
+role_arn = arn:aws:iam::123456789012:role/dev
+`
+
+func TestResolveProfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		env     map[string]string
+		config  string
+		want    string
+	}{
+		{"default", "", nil, "", "default"},
+		{"AWS_PROFILE", "", map[string]string{"AWS_PROFILE": "prod"}, "", "prod"},
+		{"AWS_DEFAULT_PROFILE", "", map[string]string{"AWS_DEFAULT_PROFILE": "dev"}, "", "dev"},
+		{"AWS_PROFILE over AWS_DEFAULT_PROFILE", "", map[string]string{"AWS_PROFILE": "prod", "AWS_DEFAULT_PROFILE": "dev"}, "", "prod"},
+		{"given over AWS_PROFILE", "ci", map[string]string{"AWS_PROFILE": "prod"}, "", "ci"},
+		{"AWS_PROFILE over access key", "", map[string]string{"AWS_PROFILE": "prod", "AWS_ACCESS_KEY_ID": "AKIDEXAMPLE"}, "", "prod"},
+		{"access key", "", map[string]string{"AWS_ACCESS_KEY_ID": "AKIDEXAMPLE"}, "", ""},
+		{"web identity", "", map[string]string{"AWS_WEB_IDENTITY_TOKEN_FILE": "/token", "AWS_ROLE_ARN": "arn:aws:iam::123456789012:role/ci"}, "", ""},
+		{"container", "", map[string]string{"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "/v2/credentials"}, "", ""},
+		{"access key with default profile", "", map[string]string{"AWS_ACCESS_KEY_ID": "AKIDEXAMPLE"}, "[default]\nregion = us-west-2\n", "default"},
+		{"web identity with other profile", "", map[string]string{"AWS_WEB_IDENTITY_TOKEN_FILE": "/token"}, "[profile prod]\nregion = eu-west-1\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setSharedConfig(t, tt.config)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			p := Params{Profile: tt.profile}
+			p.resolveProfile()
+			if p.Profile != tt.want {
+				t.Errorf("resolveProfile() = %q, want %q", p.Profile, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveProfileCredentialsFile(t *testing.T) {
+	setSharedConfig(t, "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	path := filepath.Join(t.TempDir(), "credentials")
+	err := os.WriteFile(path, []byte("[default]\naws_access_key_id = AKIDOTHER\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Params{AWSCredentialsFile: path}
+	p.resolveProfile()
+	if p.Profile != "default" {
+		t.Errorf("resolveProfile() = %q, want default", p.Profile)
+	}
+}
+
+func TestResolveRegion(t *testing.T) {
+	tests := []struct {
+		name   string
+		params Params
+		env    string
+		want   string
+	}{
+		{"profile", Params{Profile: "prod"}, "", "eu-west-1"},
+		{"default profile", Params{Profile: "default"}, "", "us-west-2"},
+		{"--region", Params{Profile: "prod", ProfileFlag: true, Region: "ap-northeast-1"}, "us-east-1", "ap-northeast-1"},
+		{"env over profile", Params{Profile: "prod"}, "us-east-1", "us-east-1"},
+		{"--profile over env", Params{Profile: "prod", ProfileFlag: true}, "us-east-1", "eu-west-1"},
+		{"host name over env", Params{Profile: "prod", ProfileFromHost: true}, "us-east-1", "eu-west-1"},
+		{"no region in profile", Params{Profile: "dev", ProfileFlag: true}, "us-east-1", "us-east-1"},
+		{"unknown profile", Params{Profile: "nope", ProfileFlag: true}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setSharedConfig(t, testSharedConfig)
+			if tt.env != "" {
+				t.Setenv("AWS_REGION", tt.env)
+			}
+			got, _ := resolveRegion(&tt.params)
+			if got != tt.want {
+				t.Errorf("resolveRegion() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveRegionConfigFileOption(t *testing.T) {
+	setSharedConfig(t, "")
+	path := filepath.Join(t.TempDir(), "other")
+	err := os.WriteFile(path, []byte("[profile ci]\nregion = sa-east-1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := resolveRegion(&Params{Profile: "ci", AWSConfigFile: path})
+	if got != "sa-east-1" {
+		t.Errorf("resolveRegion() = %q, want sa-east-1", got)
+	}
+}
+
+func TestNewClientFIPS(t *testing.T) {
+	setSharedConfig(t, "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	c, err := newClient(&Params{FIPS: true, Region: "us-east-1", NoCache: true, NoAudit: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := map[string]string{
+		"EC2":                  c.ec2.(*ec2.EC2).Endpoint,
+		"EC2 Instance Connect": c.ec2ic.(*ec2instanceconnect.EC2InstanceConnect).Endpoint,
+		"SSM":                  c.ssmEndpoint,
+	}
+	for name, e := range urls {
+		if !strings.Contains(e, "fips") {
+			t.Errorf("the %s endpoint %s is not a FIPS one", name, e)
+		}
+	}
+
+	// the plugin connects to the same FIPS endpoint
+	args, err := newSessionManagerPlugin(&Params{}).args("default", c.ssmSigningRegion, c.ssmEndpoint,
+		&ssm.StartSessionInput{}, &ssm.StartSessionOutput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args[len(args)-1] != c.ssmEndpoint {
+		t.Errorf("the plugin args %q do not end with the endpoint %s", args, c.ssmEndpoint)
+	}
+}
+
+func TestNewSessionSharedFileOptions(t *testing.T) {
+	setSharedConfig(t, "[profile ci]\nregion = us-west-2\n")
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config")
+	credentials := filepath.Join(dir, "credentials")
+	err := os.WriteFile(config, []byte("[profile ci]\nregion = sa-east-1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(credentials, []byte("[ci]\naws_access_key_id = AKIDCI\naws_secret_access_key = secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := &Params{Profile: "ci", AWSConfigFile: config, AWSCredentialsFile: credentials}
+	sess, err := newSession(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if region := aws.StringValue(sess.Config.Region); region != "sa-east-1" {
+		t.Errorf("region = %q, want sa-east-1", region)
+	}
+	v, err := sess.Config.Credentials.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.AccessKeyID != "AKIDCI" {
+		t.Errorf("access key = %q, want AKIDCI", v.AccessKeyID)
+	}
+
+	// the instances looked up with other files are cached apart
+	if newCacheKey(params, "sa-east-1") == newCacheKey(&Params{Profile: "ci"}, "sa-east-1") {
+		t.Errorf("the cache key does not depend on the shared files")
+	}
+}
+
+func TestCacheKeyEnvCredentials(t *testing.T) {
+	setSharedConfig(t, "")
+	params := &Params{Names: []string{"web"}}
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDONE")
+	one := newCacheKey(params, "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTWO")
+	if newCacheKey(params, "us-east-1") == one {
+		t.Errorf("the cache key does not depend on the access key ID of the environment")
+	}
+}
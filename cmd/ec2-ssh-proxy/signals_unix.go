@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// forwardedSignals are relayed to session-manager-plugin, so that the
+// remote terminal is resized along with the local one.
+func forwardedSignals() []os.Signal {
+	return []os.Signal{syscall.SIGWINCH}
+}
+
+// ignoredSignals are the signals from the terminal, which are meant for ssh
+// when we are its ProxyCommand. SIGHUP as well, so that the plugin exits
+// cleanly when ssh closes our stdin rather than being killed with the
+// terminal.
+func ignoredSignals() []os.Signal {
+	return []os.Signal{syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTSTP, syscall.SIGHUP}
+}
@@ -0,0 +1,143 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakePluginEnv makes the test binary act as session-manager-plugin, which
+// records the signals it receives into the file named by the variable.
+const fakePluginEnv = "EC2_SSH_PROXY_FAKE_PLUGIN"
+
+func TestMain(m *testing.M) {
+	if path := os.Getenv(fakePluginEnv); path != "" {
+		fakePlugin(path)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// fakePlugin records the signals received until its stdin is closed.
+func fakePlugin(path string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		os.Exit(2)
+	}
+	defer f.Close()
+
+	if signal.Ignored(syscall.SIGHUP) {
+		fmt.Fprintln(f, "ignored hangup")
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGWINCH)
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, os.Stdin)
+		close(done)
+	}()
+	fmt.Fprintln(f, "ready")
+	for {
+		select {
+		case s := <-ch:
+			fmt.Fprintln(f, s)
+		case <-done:
+			return
+		}
+	}
+}
+
+// recorded reports whether the fake plugin has recorded the line.
+func recorded(path string, line string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if s.Text() == line {
+			return true
+		}
+	}
+	return false
+}
+
+// waitRecorded waits for the fake plugin to record the line, calling poke
+// until then.
+func waitRecorded(t *testing.T, path string, line string, poke func()) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if recorded(path, line) {
+			return
+		}
+		if poke != nil {
+			poke()
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("the plugin did not record %q", line)
+}
+
+func TestPluginSignals(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signals")
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), fakePluginEnv+"="+path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go ignoreUserSignals(func() {
+		errc <- runForwardingSignals(cmd, nil)
+	})
+	waitRecorded(t, path, "ready", nil)
+
+	// the terminal closed must not kill us, nor the plugin
+	err = syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the window size changes must reach the plugin
+	waitRecorded(t, path, syscall.SIGWINCH.String(), func() {
+		_ = syscall.Kill(os.Getpid(), syscall.SIGWINCH)
+	})
+
+	stdin.Close()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("runForwardingSignals() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the plugin did not exit")
+	}
+	if !recorded(path, "ignored hangup") {
+		b, _ := os.ReadFile(path)
+		t.Errorf("SIGHUP is not ignored by the plugin; recorded:\n%s", strings.TrimSpace(string(b)))
+	}
+}
+
+func TestIgnoredSignals(t *testing.T) {
+	for _, want := range []os.Signal{syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTSTP, syscall.SIGHUP} {
+		found := false
+		for _, s := range ignoredSignals() {
+			found = found || s == want
+		}
+		if !found {
+			t.Errorf("ignoredSignals() = %v, want %v included", ignoredSignals(), want)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// forwardedSignals are relayed to session-manager-plugin. The console
+// resize is not a signal on Windows.
+func forwardedSignals() []os.Signal {
+	return nil
+}
+
+// ignoredSignals are the signals from the console, which are meant for ssh
+// when we are its ProxyCommand. There is no job control on Windows.
+func ignoredSignals() []os.Signal {
+	return []os.Signal{syscall.SIGINT}
+}
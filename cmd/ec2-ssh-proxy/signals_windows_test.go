@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// there is no SIGTSTP nor the other job control signals on Windows
+func TestIgnoredSignals(t *testing.T) {
+	if want := []os.Signal{syscall.SIGINT}; !reflect.DeepEqual(ignoredSignals(), want) {
+		t.Errorf("ignoredSignals() = %v, want %v", ignoredSignals(), want)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+ * ssh-config command
+ */
+
+func runSSHConfig(args []string) error {
+	var opts struct {
+		configOptions
+		awsOptions
+		selectorOptions
+		User    string        `long:"user" description:"OS user on the EC2 instance" default:"ec2-user"`
+		KeyFile string        `long:"public-key" description:"SSH public key file path (default: the first of ~/.ssh/id_ed25519.pub, id_ecdsa.pub and id_rsa.pub)"`
+		Append  string        `long:"append" description:"Append the block to the file (e.g. ~/.ssh/config) unless it is already there"`
+		Keep    time.Duration `long:"keepalive" description:"Add ServerAliveInterval to keep idle sessions alive at this interval"`
+		Args    struct {
+			HOST string `description:"Host pattern of the block (default: derived from --pattern)"`
+		} `positional-args:"yes"`
+	}
+	err := parseArgsWithConfig(newParser("ssh-config", &opts), args, &opts, &opts.configOptions, &opts.awsOptions, nil)
+	if err != nil {
+		return err
+	}
+
+	host := opts.Args.HOST
+	if host == "" {
+		host, err = hostPatterns(opts.Pattern)
+		if err != nil {
+			return err
+		}
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	block := sshConfigBlock(host, exe, &opts.awsOptions, &opts.selectorOptions, opts.User, opts.KeyFile, opts.Keep)
+
+	if opts.Append == "" {
+		_, err = fmt.Print(block)
+		return err
+	}
+	return appendSSHConfig(opts.Append, block)
+}
+
+var placeholderPattern = regexp.MustCompile(`\{\w+\}`)
+
+// hostPatterns turns the host name patterns into an ssh Host pattern list
+// by replacing the placeholders with *.
+func hostPatterns(patterns []string) (string, error) {
+	var hosts []string
+	for _, p := range patterns {
+		h := placeholderPattern.ReplaceAllString(p, "*")
+		if strings.ContainsAny(h, `[]()+?^$|\ `) {
+			return "", fmt.Errorf("can not derive the Host pattern from %s, please specify HOST", p)
+		}
+		hosts = append(hosts, h)
+	}
+	return strings.Join(hosts, " "), nil
+}
+
+func sshConfigBlock(host string, exe string, aws *awsOptions, sel *selectorOptions, user string, keyFile string, keepalive time.Duration) string {
+	// the options which differ from their defaults, given in the command
+	// line or the config file
+	cmd := []string{exe}
+	if aws.ProfileFromEnv {
+		// AWS_PROFILE is read when ssh runs the command
+		cmd = append(cmd, optionArgs(aws, "profile")...)
+	} else {
+		cmd = append(cmd, optionArgs(aws)...)
+	}
+	cmd = append(cmd, optionArgs(sel)...)
+	if keyFile != "" {
+		cmd = append(cmd, "--public-key", keyFile)
+	}
+	// ssh replaces %r with the login user given by User
+	cmd = append(cmd, "--user", "%r")
+
+	if keyFile == "" {
+		var err error
+		keyFile, err = findDefaultPublicKey()
+		if err != nil {
+			keyFile = defaultPublicKeys[0]
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Host %s\n", host)
+	fmt.Fprintf(&b, "    User %s\n", user)
+	fmt.Fprintf(&b, "    IdentityFile %s\n", strings.TrimSuffix(keyFile, ".pub"))
+	if keepalive > 0 {
+		// in seconds, at least one
+		fmt.Fprintf(&b, "    ServerAliveInterval %d\n", (keepalive+time.Second-1)/time.Second)
+	}
+	fmt.Fprintf(&b, "    ProxyCommand %s %%h %%p\n", shellJoin(cmd))
+	return b.String()
+}
+
+// appendSSHConfig appends the block to the file, unless the same block is
+// already there.
+func appendSSHConfig(path string, block string) error {
+	path, err := expandPath(path)
+	if err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if strings.Contains(string(b), block) {
+		_, _ = fmt.Fprintf(os.Stderr, "%s already has the block\n", path)
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if len(b) > 0 {
+		block = "\n" + block
+		if !strings.HasSuffix(string(b), "\n") {
+			block = "\n" + block
+		}
+	}
+	_, err = f.WriteString(block)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSSHConfigBlockOptions(t *testing.T) {
+	var opts struct {
+		awsOptions
+		selectorOptions
+	}
+	_, err := newParser("ssh-config", &opts).ParseArgs([]string{
+		"--profile", "prod", "--region", "eu-west-1", "--aws-config-file", "/tmp/config",
+		"--aws-credentials-file", "/tmp/credentials", "--max-retries", "3", "--aws-timeout", "1m",
+		"--pattern", "{name}.aws", "--name-tag-key", "hostname", "--no-anchor", "--state", "running,stopped",
+		"--tag", "env=prod", "--tag", "team=web",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := sshConfigBlock("*.aws", "ec2-ssh-proxy", &opts.awsOptions, &opts.selectorOptions, "ec2-user", "id.pub", 0)
+	want := "ProxyCommand ec2-ssh-proxy --profile prod --region eu-west-1 --aws-config-file /tmp/config" +
+		" --aws-credentials-file /tmp/credentials --aws-timeout 1m0s --max-retries 3" +
+		" --pattern '{name}.aws' --name-tag-key hostname --tag env=prod --tag team=web --state running,stopped --no-anchor" +
+		" --public-key id.pub --user %r %h %p\n"
+	if !strings.Contains(block, want) {
+		t.Errorf("sshConfigBlock() = %q, want %q", block, want)
+	}
+}
+
+func TestSSHConfigBlockDefaults(t *testing.T) {
+	var opts struct {
+		awsOptions
+		selectorOptions
+	}
+	_, err := newParser("ssh-config", &opts).ParseArgs(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := sshConfigBlock("ec2.*", "ec2-ssh-proxy", &opts.awsOptions, &opts.selectorOptions, "ec2-user", "id.pub", 0)
+	want := "ProxyCommand ec2-ssh-proxy --public-key id.pub --user %r %h %p\n"
+	if !strings.Contains(block, want) {
+		t.Errorf("sshConfigBlock() = %q, want %q", block, want)
+	}
+}
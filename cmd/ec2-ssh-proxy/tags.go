@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+ * Instance tags
+ */
+
+// showTags prints the tags of the instance to stderr, even with --quiet, to
+// confirm where the session is about to go. The tags of AWS, such as the
+// ones of Auto Scaling and CloudFormation, are left out.
+func showTags(i *ec2.Instance, nameKey string) {
+	var tags []string
+	for _, t := range i.Tags {
+		k := aws.StringValue(t.Key)
+		if strings.HasPrefix(k, "aws:") {
+			continue
+		}
+		tags = append(tags, k+"="+aws.StringValue(t.Value))
+	}
+	// the name first, and the others in order
+	sort.Slice(tags, func(a, b int) bool {
+		an := strings.HasPrefix(tags[a], nameKey+"=")
+		bn := strings.HasPrefix(tags[b], nameKey+"=")
+		if an != bn {
+			return an
+		}
+		return tags[a] < tags[b]
+	})
+	if len(tags) == 0 {
+		tags = []string{"(none)"}
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "tags of %s: %s\n", aws.StringValue(i.InstanceId), strings.Join(tags, ", "))
+}
+
+// checkRequiredTags fails unless the instance has all the tags, which guards
+// against connecting to an instance selected by mistake.
+func checkRequiredTags(i *ec2.Instance, required []Tag) error {
+	for _, r := range required {
+		v, ok := "", false
+		for _, t := range i.Tags {
+			if aws.StringValue(t.Key) == r.Key {
+				v, ok = aws.StringValue(t.Value), true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("instance %s does not have the required tag %s=%s (no %s tag)", aws.StringValue(i.InstanceId), r.Key, r.Value, r.Key)
+		}
+		if v != r.Value {
+			return fmt.Errorf("instance %s does not have the required tag %s=%s (%s=%s)", aws.StringValue(i.InstanceId), r.Key, r.Value, r.Key, v)
+		}
+	}
+	return nil
+}
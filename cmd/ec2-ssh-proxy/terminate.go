@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"os"
+)
+
+/*
+ * terminate command
+ */
+
+func runTerminate(args []string) error {
+	var opts struct {
+		configOptions
+		logOptions
+		awsOptions
+		AllMine bool `long:"all-mine" description:"Terminate all the active sessions started by the current identity"`
+		Args    struct {
+			SESSION_ID []string
+		} `positional-args:"yes"`
+	}
+	err := parseArgsWithConfig(newParser("terminate", &opts), args, &opts, &opts.configOptions, &opts.awsOptions, nil)
+	if err != nil {
+		return err
+	}
+	err = opts.logOptions.apply()
+	if err != nil {
+		return err
+	}
+	if opts.AllMine == (len(opts.Args.SESSION_ID) > 0) {
+		return fmt.Errorf("either session IDs or --all-mine is required")
+	}
+
+	params := Params{}
+	err = opts.awsOptions.apply(&params)
+	if err != nil {
+		return err
+	}
+	params.resolveProfile()
+
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+
+	client, err := newClient(&params)
+	if err != nil {
+		return err
+	}
+
+	ids := opts.Args.SESSION_ID
+	if opts.AllMine {
+		ids, err = client.activeSessions(ctx)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			if !logger.quiet() {
+				_, _ = fmt.Fprintln(os.Stderr, "no active session is found")
+			}
+			return nil
+		}
+	}
+
+	var failed int
+	for _, id := range ids {
+		err := client.terminateSession(id)
+		if err != nil {
+			logger.Warnf("failed to terminate session %s: %v", id, err)
+			failed++
+			continue
+		}
+		if !logger.quiet() {
+			fmt.Printf("terminated %s\n", id)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to terminate %d of %d sessions", failed, len(ids))
+	}
+	return nil
+}
+
+// activeSessions returns the IDs of the active sessions owned by the caller.
+func (c *Client) activeSessions(ctx context.Context) ([]string, error) {
+	var identity *sts.GetCallerIdentityOutput
+	err := c.call(ctx, func(ctx aws.Context) (err error) {
+		identity, err = c.sts.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	owner := aws.StringValue(identity.Arn)
+	logger.Infof("looking up the active sessions of %s", owner)
+
+	var ids []string
+	in := &ssm.DescribeSessionsInput{
+		State: aws.String(ssm.SessionStateActive),
+		Filters: []*ssm.SessionFilter{
+			{Key: aws.String(ssm.SessionFilterKeyOwner), Value: aws.String(owner)},
+		},
+	}
+	for {
+		var out *ssm.DescribeSessionsOutput
+		err = c.call(ctx, func(ctx aws.Context) (err error) {
+			out, err = c.ssm.DescribeSessionsWithContext(ctx, in)
+			return
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range out.Sessions {
+			ids = append(ids, aws.StringValue(s.SessionId))
+		}
+		if aws.StringValue(out.NextToken) == "" {
+			return ids, nil
+		}
+		in.NextToken = out.NextToken
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"regexp"
+	"strings"
+)
+
+/*
+ * OS user detection
+ */
+
+// UserMapping maps AMI names matching Pattern (a glob, case-insensitive)
+// to the default OS user of the AMI.
+type UserMapping struct {
+	Pattern string
+	User    string
+}
+
+var defaultUserMappings = []UserMapping{
+	{"amzn*", "ec2-user"},
+	{"al20*", "ec2-user"},
+	{"ubuntu*", "ubuntu"},
+	{"debian*", "admin"},
+	{"rhel*", "ec2-user"},
+	{"centos*", "centos"},
+	{"fedora*", "fedora"},
+	{"suse*", "ec2-user"},
+	{"rocky*", "rocky"},
+	{"almalinux*", "ec2-user"},
+	{"bitnami*", "bitnami"},
+	{"freebsd*", "ec2-user"},
+}
+
+func parseUserMappings(a []string) ([]UserMapping, error) {
+	var ret []UserMapping
+	for _, s := range a {
+		k, v, err := parseKeyValue(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user mapping: %v", err)
+		}
+		ret = append(ret, UserMapping{Pattern: k, User: v})
+	}
+	return ret, nil
+}
+
+// userForImage returns the user of the first mapping matching the AMI name.
+func userForImage(name string, mappings []UserMapping) string {
+	for _, m := range mappings {
+		if globMatch(m.Pattern, name) {
+			return m.User
+		}
+	}
+	return ""
+}
+
+// globMatch matches s against a pattern where * matches any characters
+// including /, which AMI names often contain, and ? matches any one.
+func globMatch(pattern string, s string) bool {
+	pat := regexp.QuoteMeta(pattern)
+	pat = strings.ReplaceAll(pat, `\*`, ".*")
+	pat = strings.ReplaceAll(pat, `\?`, ".")
+	return regexp.MustCompile("(?i)^" + pat + "$").MatchString(s)
+}
+
+var userTemplatePattern = regexp.MustCompile(`^\{tag:(.+)\}$`)
+
+// the user for a {tag:KEY} template when the instance has no such tag
+const templateFallbackUser = "ec2-user"
+
+// resolveUsers expands the users given as {tag:KEY} with the tags of the
+// instance.
+func resolveUsers(users []string, i *ec2.Instance) []string {
+	var ret []string
+	for _, u := range users {
+		if m := userTemplatePattern.FindStringSubmatch(u); m != nil {
+			u = instanceTag(i, m[1])
+			if u == "" {
+				logger.Infof("the instance has no %s tag, using OS user %s", m[1], templateFallbackUser)
+				u = templateFallbackUser
+			} else {
+				logger.Infof("using OS user %s from the %s tag", u, m[1])
+			}
+		}
+		if !containsString(ret, u) {
+			ret = append(ret, u)
+		}
+	}
+	return ret
+}
+
+// detectUser looks up the AMI of the instance and returns its default OS
+// user. The --user option is used when the AMI is not known.
+func (c *Client) detectUser(ctx context.Context, params *Params, i *ec2.Instance) []string {
+	imageId := aws.StringValue(i.ImageId)
+	if imageId == "" {
+		logger.Infof("OS user detection failed: the AMI of the instance is unknown")
+		return params.Users
+	}
+
+	var out *ec2.DescribeImagesOutput
+	err := c.call(ctx, func(ctx aws.Context) (err error) {
+		out, err = c.ec2.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+			ImageIds: []*string{aws.String(imageId)},
+		})
+		return
+	})
+	if err != nil {
+		logger.Infof("OS user detection failed: %v", err)
+		return params.Users
+	}
+	if len(out.Images) == 0 {
+		logger.Infof("OS user detection failed: %s is not found", imageId)
+		return params.Users
+	}
+
+	name := aws.StringValue(out.Images[0].Name)
+	user := userForImage(name, append(params.UserMappings, defaultUserMappings...))
+	if user == "" {
+		logger.Infof("OS user for AMI %s (%s) is not known, using %s", imageId, name, strings.Join(params.Users, ", "))
+		return params.Users
+	}
+	logger.Infof("detected OS user %s from AMI %s (%s)", user, imageId, name)
+	return []string{user}
+}
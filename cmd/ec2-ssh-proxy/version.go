@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"text/tabwriter"
+)
+
+/*
+ * version command
+ */
+
+// Set by -ldflags "-X main.version=...", which goreleaser does by default.
+var (
+	version = ""
+	commit  = ""
+	date    = ""
+)
+
+type BuildInfo struct {
+	Version   string
+	Commit    string
+	Date      string
+	GoVersion string
+}
+
+// buildInfo returns the injected build metadata, falling back to what the Go
+// toolchain recorded in the binary, e.g. by go install.
+func buildInfo() BuildInfo {
+	b := BuildInfo{Version: version, Commit: commit, Date: date, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if b.Version == "" && bi.Main.Version != "(devel)" {
+			b.Version = bi.Main.Version
+		}
+		modified := false
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if b.Commit == "" {
+					b.Commit = s.Value
+				}
+			case "vcs.time":
+				if b.Date == "" {
+					b.Date = s.Value
+				}
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+		if modified && commit == "" && b.Commit != "" {
+			b.Commit += "-dirty"
+		}
+	}
+	if b.Version == "" {
+		b.Version = "dev"
+	}
+	if b.Commit == "" {
+		b.Commit = "unknown"
+	}
+	if b.Date == "" {
+		b.Date = "unknown"
+	}
+	return b
+}
+
+func runVersion(args []string) error {
+	var opts struct {
+		Plugin string `long:"plugin-path" description:"Path to the session-manager-plugin binary" env:"EC2_SSH_PROXY_PLUGIN_PATH"`
+	}
+	_, err := newParser("version", &opts).ParseArgs(args)
+	if err != nil {
+		return err
+	}
+
+	b := buildInfo()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	_, _ = fmt.Fprintf(w, "ec2-ssh-proxy\t%s\n", b.Version)
+	_, _ = fmt.Fprintf(w, "commit:\t%s\n", b.Commit)
+	_, _ = fmt.Fprintf(w, "built:\t%s\n", b.Date)
+	_, _ = fmt.Fprintf(w, "go:\t%s %s/%s\n", b.GoVersion, runtime.GOOS, runtime.GOARCH)
+	_, _ = fmt.Fprintf(w, "session-manager-plugin:\t%s\n", pluginVersion(opts.Plugin))
+	return w.Flush()
+}
+
+// pluginVersion describes the session-manager-plugin found, if any.
+func pluginVersion(path string) string {
+	plugin := &SessionManagerPluginImpl{path: path, skipVersionCheck: true}
+	err := plugin.check()
+	if err != nil {
+		return "not found"
+	}
+	v, err := plugin.version()
+	if err != nil {
+		return fmt.Sprintf("unknown (%s)", plugin.path)
+	}
+	return fmt.Sprintf("%s (%s)", v, plugin.path)
+}
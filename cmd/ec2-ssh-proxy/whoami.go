@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"os"
+	"text/tabwriter"
+)
+
+/*
+ * whoami command
+ */
+
+// runWhoami prints the IAM identity the proxy would connect with, after the
+// role assumption if any, without connecting. The profile is the one the
+// host name resolves to when HOST is given.
+func runWhoami(args []string) error {
+	var opts struct {
+		configOptions
+		logOptions
+		awsOptions
+		selectorOptions
+		Args struct {
+			HOST hostArg
+		} `positional-args:"yes"`
+	}
+	hostProfile := func() string { return opts.selectorOptions.hostProfile(string(opts.Args.HOST)) }
+	err := parseArgsWithConfig(newParser("whoami", &opts), args, &opts, &opts.configOptions, &opts.awsOptions, hostProfile)
+	if err != nil {
+		return err
+	}
+	err = opts.logOptions.apply()
+	if err != nil {
+		return err
+	}
+
+	params := Params{NoCache: true, NoAudit: true}
+	err = opts.awsOptions.apply(&params)
+	if err != nil {
+		return err
+	}
+	if opts.Args.HOST != "" {
+		err = opts.selectorOptions.apply(&params)
+		if err != nil {
+			return err
+		}
+		err = opts.selectorOptions.parseHost(string(opts.Args.HOST), &params)
+		if err != nil {
+			return err
+		}
+	}
+	params.resolveProfile()
+
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+
+	client, err := newClient(&params)
+	if err != nil {
+		return err
+	}
+	var out *sts.GetCallerIdentityOutput
+	err = client.call(ctx, func(ctx aws.Context) (err error) {
+		out, err = client.sts.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+		return
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get the caller identity: %v", err)
+	}
+
+	profile := params.Profile
+	if profile == "" {
+		profile = "(default)"
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	_, _ = fmt.Fprintf(w, "account:\t%s\n", aws.StringValue(out.Account))
+	_, _ = fmt.Fprintf(w, "arn:\t%s\n", aws.StringValue(out.Arn))
+	_, _ = fmt.Fprintf(w, "user id:\t%s\n", aws.StringValue(out.UserId))
+	_, _ = fmt.Fprintf(w, "profile:\t%s\n", profile)
+	_, _ = fmt.Fprintf(w, "region:\t%s\n", client.region)
+	return w.Flush()
+}
@@ -1,8 +1,17 @@
 module github.com/ojima-h/ec2-ssh-proxy
 
-go 1.14
+go 1.20
 
 require (
-	github.com/aws/aws-sdk-go v1.29.34
+	github.com/aws/aws-sdk-go v1.55.8
 	github.com/jessevdk/go-flags v1.4.0
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.25.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
 )